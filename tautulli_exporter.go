@@ -2,32 +2,167 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/caarlos0/env"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/tidwall/gjson"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
 )
 
 const (
 	namespace = "tautulli"
 	userAgent = "tautulli-prometheus-exporter"
+
+	// Plex caps streams through its relay at 2 Mbps
+	relayBitrateLimit = 2000
+
+	// Duplicate session keys are logged at most this often
+	duplicateSessionLogEvery = 10 * time.Minute
+)
+
+var (
+	// Tautulli sent something that isn't complete JSON, like an HTML error page or a truncated body
+	errInvalidResponse = errors.New("invalid response")
+
+	// A collector didn't finish before SCRAPE_TIMEOUT
+	errScrapeTimeout = errors.New("scrape timeout")
 )
 
+// Tautulli, or a proxy in front of it, answered with a non-2xx status
+type httpStatusError struct {
+	statusCode int
+}
+
+func (err *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP status %d", err.statusCode)
+}
+
+// Tautulli answered, but with a result other than success, like for a bad API key
+type resultError struct {
+	cmd, result, message string
+}
+
+func (err *resultError) Error() string {
+	return fmt.Sprintf("%s returned result %q: %s", err.cmd, err.result, err.message)
+}
+
 var (
 	streamLabelNames    = []string{"stream"}
 	bandwidthLabelNames = []string{"bandwidth"}
+	sessionLabelNames   = []string{"session_key", "session_id", "user"}
+	homeStatLabelNames  = []string{"stat_id", "name"}
+
+	// Row field used as the name label for each supported home stat
+	homeStatNameFields = map[string]string{
+		"top_movies":      "title",
+		"popular_movies":  "title",
+		"top_tv":          "title",
+		"popular_tv":      "title",
+		"top_music":       "title",
+		"popular_music":   "title",
+		"top_libraries":   "section_name",
+		"top_users":       "friendly_name",
+		"top_platforms":   "platform",
+		"most_concurrent": "title",
+	}
+
+	// Fields the exporter expects in every get_activity response
+	activityFields = []string{
+		"stream_count",
+		"stream_count_transcode",
+		"stream_count_direct_play",
+		"stream_count_direct_stream",
+		"total_bandwidth",
+		"lan_bandwidth",
+		"wan_bandwidth",
+		"sessions",
+	}
+
+	// Per-session values that are derived from several session fields
+	derivedSessionFields = map[string]func(session gjson.Result) float64{
+		"transcode_hw":      sessionTranscodeHw,
+		"remaining_seconds": sessionRemainingSeconds,
+		"subtitle_burn":     sessionSubtitleBurn,
+		"relay_limited":     sessionRelayLimited,
+	}
+
+	// Versions accepted by TAUTULLI_MIN_TLS_VERSION
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	// Multipliers to convert Tautulli's kbps into each BANDWIDTH_UNIT
+	bandwidthUnits = map[string]float64{
+		"kbps": 1,
+		"bps":  1000,
+		"Bps":  125,
+	}
+
+	// Custom metric names have to be valid Prometheus metric names
+	customMetricName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	// Heights of Tautulli's resolution names, for sessions that don't report the video height
+	resolutionHeights = map[string]float64{
+		"sd":   480,
+		"480":  480,
+		"576":  576,
+		"720":  720,
+		"1080": 1080,
+		"2k":   1440,
+		"1440": 1440,
+		"4k":   2160,
+	}
+
+	// Optional collectors that can be enabled with COLLECTORS, in the order they're scraped
+	availableCollectors = []struct {
+		name   string
+		scrape collector
+	}{
+		{"sync", (*Exporter).scrapeSync},
+		{"server", (*Exporter).scrapeServer},
+		{"history", (*Exporter).scrapeHistory},
+		{"libraries", (*Exporter).scrapeLibraries},
+		{"user_watch_time", (*Exporter).scrapeUserWatchTime},
+		{"tautulli_info", (*Exporter).scrapeTautulliInfo},
+		{"newsletters", (*Exporter).scrapeNewsletters},
+		{"users", (*Exporter).scrapeUsers},
+		{"recently_added", (*Exporter).scrapeRecentlyAdded},
+		{"server_status", (*Exporter).scrapeServerStatus},
+		{"transcode_limit", (*Exporter).scrapeTranscodeLimit},
+		{"base_url", (*Exporter).scrapeBaseURL},
+	}
 )
 
 func newStreamMetric(metricName string, docString string, constLabels prometheus.Labels) *prometheus.GaugeVec {
@@ -54,6 +189,156 @@ func newBandwidthMetric(metricName string, docString string, constLabels prometh
 	)
 }
 
+func newSessionMetric(metricName string, docString string, constLabels prometheus.Labels) *trackedGaugeVec {
+	return newTrackedGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "session_" + metricName,
+			Help:        docString,
+			ConstLabels: constLabels,
+		},
+		sessionLabelNames,
+	)
+}
+
+// A GaugeVec that remembers which label values were set during a scrape, so series
+// that didn't show up again can be deleted instead of lingering forever
+type trackedGaugeVec struct {
+	*prometheus.GaugeVec
+
+	// Collectors that missed the scrape deadline can still be setting values
+	mutex             sync.Mutex
+	previous, current map[string][]string
+
+	// Series kept at 0 for one scrape after they disappeared, with EMPTY_SERIES_MODE=zero
+	stale map[string]bool
+}
+
+func newTrackedGaugeVec(opts prometheus.GaugeOpts, labelNames []string) *trackedGaugeVec {
+	return &trackedGaugeVec{
+		GaugeVec: prometheus.NewGaugeVec(opts, labelNames),
+		previous: make(map[string][]string),
+		current:  make(map[string][]string),
+		stale:    make(map[string]bool),
+	}
+}
+
+// Returns the gauge for the label values and marks them as seen in this scrape
+func (v *trackedGaugeVec) WithLabelValues(lvs ...string) prometheus.Gauge {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.current[strings.Join(lvs, "\xff")] = lvs
+	return v.GaugeVec.WithLabelValues(lvs...)
+}
+
+// Zeroes the series from the previous scrape so they can be counted up again
+func (v *trackedGaugeVec) reset() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for _, lvs := range v.previous {
+		v.GaugeVec.WithLabelValues(lvs...).Set(0)
+	}
+}
+
+// Deletes the series that weren't set in this scrape. With keepZero they're reported
+// as 0 for one more scrape first, reset already zeroed them.
+func (v *trackedGaugeVec) sweep(keepZero bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	stale := make(map[string]bool)
+	for key, lvs := range v.previous {
+		if _, ok := v.current[key]; ok {
+			continue
+		}
+		if keepZero && !v.stale[key] {
+			stale[key] = true
+			v.current[key] = lvs
+			continue
+		}
+		v.GaugeVec.DeleteLabelValues(lvs...)
+	}
+	v.stale = stale
+	v.previous = v.current
+	v.current = make(map[string][]string)
+}
+
+// Stream counts seen over the last window, from both scrapes and the samples taken between them
+type streamSampler struct {
+	mutex   sync.Mutex
+	window  time.Duration
+	samples []streamSample
+}
+
+type streamSample struct {
+	at          time.Time
+	streamCount float64
+}
+
+func newStreamSampler(window time.Duration) *streamSampler {
+	return &streamSampler{window: window}
+}
+
+// Adds a sample taken at the given time
+func (s *streamSampler) add(at time.Time, streamCount float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.samples = append(s.samples, streamSample{at: at, streamCount: streamCount})
+	s.evict(at)
+}
+
+// Returns the highest sample in the window ending now
+func (s *streamSampler) max(now time.Time) float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.evict(now)
+	max := 0.0
+	for _, sample := range s.samples {
+		max = math.Max(max, sample.streamCount)
+	}
+	return max
+}
+
+// Drops the samples older than the window, samples are always added in order
+func (s *streamSampler) evict(now time.Time) {
+	i := 0
+	for i < len(s.samples) && now.Sub(s.samples[i].at) > s.window {
+		i++
+	}
+	s.samples = append(s.samples[:0], s.samples[i:]...)
+}
+
+// Stream count samples taken since the last scrape
+type streamStats struct {
+	mutex         sync.Mutex
+	min, max, sum float64
+	count         int
+}
+
+// Adds a sample to the current scrape interval
+func (s *streamStats) add(streamCount float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.count == 0 || streamCount < s.min {
+		s.min = streamCount
+	}
+	if s.count == 0 || streamCount > s.max {
+		s.max = streamCount
+	}
+	s.sum += streamCount
+	s.count++
+}
+
+// Returns the lowest, highest and average sample and starts a new interval, all 0 without samples
+func (s *streamStats) take() (min float64, max float64, avg float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.count > 0 {
+		min, max, avg = s.min, s.max, s.sum/float64(s.count)
+	}
+	s.min, s.max, s.sum, s.count = 0, 0, 0, 0
+	return min, max, avg
+}
+
 type metrics map[int]*prometheus.GaugeVec
 
 func (m metrics) String() string {
@@ -69,229 +354,2955 @@ func (m metrics) String() string {
 	return strings.Join(s, ",")
 }
 
-type config struct {
-	TautulliApiKey    string        `env:"TAUTULLI_API_KEY"`
-	TautulliScrapeUri string        `env:"TAUTULLI_URI" envDefault:"http://127.0.0.1:8181"`
-	TautulliSslVerify bool          `env:"TAUTULLI_SSL_VERIFY" envDefault:"false"`
-	TautulliTimeout   time.Duration `env:"TAUTULLI_TIMEOUT" envDefault:"5s"`
-	ServePort         string        `env:"SERVE_PORT" envDefault:"9487"`
+// A gauge read from a user supplied path in the get_activity data
+type customMetric struct {
+	path  string
+	gauge prometheus.Gauge
 }
 
-type Exporter struct {
-	URI   string
-	mutex sync.RWMutex
-	fetch func() (io.ReadCloser, error)
+type config struct {
+	TautulliApiKey       string        `env:"TAUTULLI_API_KEY" yaml:"tautulli_api_key"`
+	ApiKeyInPath         bool          `env:"TAUTULLI_APIKEY_IN_PATH" envDefault:"false" yaml:"tautulli_apikey_in_path"`
+	TautulliScrapeUri    string        `env:"TAUTULLI_URI" envDefault:"http://127.0.0.1:8181" yaml:"tautulli_uri"`
+	TautulliSslVerify    bool          `env:"TAUTULLI_SSL_VERIFY" envDefault:"true" yaml:"tautulli_ssl_verify"`
+	TautulliCaFile       string        `env:"TAUTULLI_CA_FILE" yaml:"tautulli_ca_file"`
+	MinTLSVersion        string        `env:"TAUTULLI_MIN_TLS_VERSION" yaml:"tautulli_min_tls_version"`
+	TautulliTimeout      time.Duration `env:"TAUTULLI_TIMEOUT" envDefault:"5s" yaml:"tautulli_timeout"`
+	ScrapeTimeout        time.Duration `env:"SCRAPE_TIMEOUT" envDefault:"0" yaml:"scrape_timeout"`
+	FollowRedirects      bool          `env:"TAUTULLI_FOLLOW_REDIRECTS" envDefault:"true" yaml:"tautulli_follow_redirects"`
+	ExtraHeaders         []string      `env:"TAUTULLI_EXTRA_HEADERS" yaml:"tautulli_extra_headers"`
+	AcceptLanguage       string        `env:"TAUTULLI_ACCEPT_LANGUAGE" yaml:"tautulli_accept_language"`
+	FileSource           string        `env:"TAUTULLI_FILE_SOURCE" yaml:"tautulli_file_source"`
+	MaxRPS               float64       `env:"TAUTULLI_MAX_RPS" envDefault:"0" yaml:"tautulli_max_rps"`
+	BandwidthUnit        string        `env:"BANDWIDTH_UNIT" envDefault:"kbps" yaml:"bandwidth_unit"`
+	ZeroIdleBandwidth    bool          `env:"ZERO_BANDWIDTH_WHEN_IDLE" envDefault:"false" yaml:"zero_bandwidth_when_idle"`
+	MetricSchema         string        `env:"METRIC_SCHEMA" envDefault:"v1" yaml:"metric_schema"`
+	SessionMetrics       bool          `env:"SESSION_METRICS" envDefault:"false" yaml:"session_metrics"`
+	MachineIDLabel       bool          `env:"PLEX_MACHINE_ID_LABEL" envDefault:"false" yaml:"plex_machine_id_label"`
+	EmptySeriesMode      string        `env:"EMPTY_SERIES_MODE" envDefault:"remove" yaml:"empty_series_mode"`
+	WanBandwidthCap      float64       `env:"WAN_BANDWIDTH_CAP_KBPS" envDefault:"0" yaml:"wan_bandwidth_cap_kbps"`
+	TranscodeAlert       float64       `env:"TRANSCODE_ALERT_THRESHOLD" envDefault:"1000" yaml:"transcode_alert_threshold"`
+	HighBitrate          float64       `env:"HIGH_BITRATE_THRESHOLD_KBPS" envDefault:"20000" yaml:"high_bitrate_threshold_kbps"`
+	LongPauseAfter       time.Duration `env:"LONG_PAUSE_THRESHOLD" envDefault:"30m" yaml:"long_pause_threshold"`
+	StallAfter           time.Duration `env:"STALL_THRESHOLD" envDefault:"30s" yaml:"stall_threshold"`
+	StreamMaxReset       time.Duration `env:"STREAM_COUNT_MAX_RESET_INTERVAL" envDefault:"0" yaml:"stream_count_max_reset_interval"`
+	StreamWindow         time.Duration `env:"STREAM_COUNT_WINDOW" envDefault:"0" yaml:"stream_count_window"`
+	StreamSampleEvery    time.Duration `env:"STREAM_SAMPLE_INTERVAL" envDefault:"15s" yaml:"stream_sample_interval"`
+	StreamStats          bool          `env:"STREAM_COUNT_INTERVAL_STATS" envDefault:"false" yaml:"stream_count_interval_stats"`
+	HomeStats            []string      `env:"HOME_STATS" envDefault:"top_movies,top_tv,top_users" yaml:"home_stats"`
+	HomeStatsCount       int           `env:"HOME_STATS_COUNT" envDefault:"5" yaml:"home_stats_count"`
+	Collectors           []string      `env:"COLLECTORS" yaml:"collectors"`
+	UserStatsDays        int           `env:"USER_STATS_DAYS" envDefault:"30" yaml:"user_stats_days"`
+	UserStatsRefresh     time.Duration `env:"USER_STATS_REFRESH_INTERVAL" envDefault:"1h" yaml:"user_stats_refresh_interval"`
+	UserStatsJitter      time.Duration `env:"USER_STATS_REFRESH_JITTER" envDefault:"0" yaml:"user_stats_refresh_jitter"`
+	UserStatsConcurrency int           `env:"USER_STATS_CONCURRENCY" envDefault:"1" yaml:"user_stats_concurrency"`
+	StartupProbe         bool          `env:"STARTUP_PROBE" envDefault:"false" yaml:"startup_probe"`
+	DebugEndpoints       bool          `env:"DEBUG_ENDPOINTS" envDefault:"false" yaml:"debug_endpoints"`
+	DebugMetrics         bool          `env:"DEBUG_METRICS" envDefault:"false" yaml:"debug_metrics"`
+	InfluxFormat         bool          `env:"INFLUX_FORMAT" envDefault:"false" yaml:"influx_format"`
+	CustomMetrics        []string      `env:"CUSTOM_METRICS" yaml:"custom_metrics"`
+	ScrapeBuckets        []float64     `env:"SCRAPE_DURATION_BUCKETS" envDefault:"0.05,0.1,0.25,0.5,1,2.5,5,10" yaml:"scrape_duration_buckets"`
+	ServePort            string        `env:"SERVE_PORT" envDefault:"9487" yaml:"serve_port"`
+	ListenAddress        string        `env:"WEB_LISTEN_ADDRESS" yaml:"web_listen_address"`
+	AdminAddress         string        `env:"ADMIN_LISTEN_ADDRESS" yaml:"admin_listen_address"`
+	WebIdleTimeout       time.Duration `env:"WEB_IDLE_TIMEOUT" envDefault:"2m" yaml:"web_idle_timeout"`
+	WebWriteTimeout      time.Duration `env:"WEB_WRITE_TIMEOUT" envDefault:"2m" yaml:"web_write_timeout"`
+	EnablePprof          bool          `env:"ENABLE_PPROF" envDefault:"false" yaml:"enable_pprof"`
+	ConfigDir            string        `env:"CONFIG_DIR" yaml:"config_dir"`
 
-	up, streamTotal, streamTranscode, streamDirectPlay, streamDirectStream, bandwidthTotal, bandwidthLan, bandwidthWan prometheus.Gauge
-	totalScrapes                                                                                                       prometheus.Counter
-	streamMetrics, bandwidthMetrics                                                                                    map[string]*prometheus.GaugeVec
+	// Servers and help overrides can only be set in the config file
+	Servers       []serverConfig    `yaml:"servers"`
+	HelpOverrides map[string]string `yaml:"help_overrides"`
 }
 
-var (
-	version string
-)
-
-func NewExporter(uri string, sslVerify bool, timeout time.Duration) (*Exporter, error) {
-	var fetch = fetchHTTP(uri, sslVerify, timeout)
+// Returns the help text for a metric, using the override from the config file if there is one
+func (cfg config) help(name string, defaultHelp string) string {
+	if help, ok := cfg.HelpOverrides[namespace+"_"+name]; ok {
+		return help
+	}
+	return defaultHelp
+}
 
-	return &Exporter{
-		URI:   uri,
-		fetch: fetch,
-		up: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "up",
-			Help:      "Was the last scrape of Tautulli successful",
-		}),
-		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: namespace,
-			Name:      "exporter_total_scrapes",
-			Help:      "Current total Tautulli scrapes",
-		}),
-		streamTotal: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "stream_count",
-			Help:      "Number of total streams.",
-		}),
-		streamTranscode: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "stream_count_transcode",
-			Help:      "Number of streams that are transcoding.",
-		}),
-		streamDirectPlay: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "stream_direct_play",
-			Help:      "Number of streams that are direct_plays.",
-		}),
-		streamDirectStream: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "stream_direct_stream",
-			Help:      "Number of streams that are direct streams.",
-		}),
-		bandwidthTotal: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "bandwidth_total",
-			Help:      "Total bandwidth utilized.",
-		}),
-		bandwidthLan: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "bandwidth_lan",
-			Help:      "LAN bandwidth utilized.",
-		}),
-		bandwidthWan: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "bandwidth_wan",
-			Help:      "WAN bandwidth utilized.",
-		}),
-	}, nil
+// A single Tautulli server from the config file, unset values fall back to the top level config
+type serverConfig struct {
+	Name              string        `yaml:"name"`
+	Tenant            string        `yaml:"tenant"`
+	TautulliApiKey    string        `yaml:"tautulli_api_key"`
+	TautulliScrapeUri string        `yaml:"tautulli_uri"`
+	TautulliSslVerify *bool         `yaml:"tautulli_ssl_verify"`
+	TautulliCaFile    string        `yaml:"tautulli_ca_file"`
+	TautulliTimeout   time.Duration `yaml:"tautulli_timeout"`
+	ExtraHeaders      []string      `yaml:"tautulli_extra_headers"`
 }
 
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- e.up.Desc()
-	ch <- e.totalScrapes.Desc()
-	ch <- e.streamTotal.Desc()
-	ch <- e.streamTranscode.Desc()
-	ch <- e.streamDirectPlay.Desc()
-	ch <- e.streamDirectStream.Desc()
-	ch <- e.bandwidthTotal.Desc()
-	ch <- e.bandwidthLan.Desc()
-	ch <- e.bandwidthWan.Desc()
+// Returns the config to use for a single server
+func (cfg config) forServer(server serverConfig) config {
+	// Tenants never fall back to the top level credentials, so one tenant can't end up using another's
+	if len(server.Tenant) > 0 {
+		cfg.TautulliApiKey = server.TautulliApiKey
+		cfg.ExtraHeaders = server.ExtraHeaders
+	}
+	if len(server.TautulliApiKey) > 0 {
+		cfg.TautulliApiKey = server.TautulliApiKey
+	}
+	if len(server.ExtraHeaders) > 0 {
+		cfg.ExtraHeaders = server.ExtraHeaders
+	}
+	if len(server.TautulliScrapeUri) > 0 {
+		cfg.TautulliScrapeUri = server.TautulliScrapeUri
+	}
+	if server.TautulliSslVerify != nil {
+		cfg.TautulliSslVerify = *server.TautulliSslVerify
+	}
+	if len(server.TautulliCaFile) > 0 {
+		cfg.TautulliCaFile = server.TautulliCaFile
+	}
+	if server.TautulliTimeout > 0 {
+		cfg.TautulliTimeout = server.TautulliTimeout
+	}
+	return cfg
 }
 
-// Implements prometheus.Collector.
-// Resets the metrics, fetches stats, and provides the metrics.
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	e.mutex.Lock() // Protects metrics from concurrent collects.
-	defer e.mutex.Unlock()
+// Loads a YAML config file into cfg, keeping any values that were set through environment variables
+func loadConfigFile(path string, cfg *config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
 
-	e.resetMetrics()
-	e.scrape()
+	envCfg := *cfg
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("can't parse config file %s: %w", path, err)
+	}
 
-	ch <- e.up
-	ch <- e.totalScrapes
-	ch <- e.streamTotal
-	ch <- e.streamTranscode
-	ch <- e.streamDirectPlay
-	ch <- e.streamDirectStream
-	ch <- e.bandwidthTotal
-	ch <- e.bandwidthLan
-	ch <- e.bandwidthWan
+	fileValues := reflect.ValueOf(cfg).Elem()
+	envValues := reflect.ValueOf(envCfg)
+	for i := 0; i < fileValues.NumField(); i++ {
+		key := strings.Split(fileValues.Type().Field(i).Tag.Get("env"), ",")[0]
+		if _, ok := os.LookupEnv(key); ok && len(key) > 0 {
+			fileValues.Field(i).Set(envValues.Field(i))
+		}
+	}
+	return nil
 }
 
-// Fetches stats from Tautulli for later processing
-func fetchHTTP(uri string, sslVerify bool, timeout time.Duration) func() (io.ReadCloser, error) {
+// Checks that a server's config has an API key, responses read from disk don't need one
+func checkAPIKey(cfg config) error {
+	if len(cfg.FileSource) > 0 {
+		return nil
+	}
+	if len(strings.TrimSpace(cfg.TautulliApiKey)) == 0 {
+		return errors.New("no API key set, set TAUTULLI_API_KEY or tautulli_api_key in the config file")
+	}
+	return nil
+}
 
-	tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: !sslVerify}}
-	client := http.Client{
-		Timeout:   timeout,
-		Transport: tr,
+// Loads a server from every YAML file in dir, servers without a name are named after their file
+func loadServerDir(dir string) ([]serverConfig, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.y*ml"))
+	if err != nil {
+		return nil, err
 	}
+	sort.Strings(paths)
+
+	var servers []serverConfig
+	for _, path := range paths {
+		ext := filepath.Ext(path)
+		if ext != ".yml" && ext != ".yaml" {
+			continue
+		}
 
-	return func() (io.ReadCloser, error) {
-		resp, err := client.Get(uri)
+		data, err := os.ReadFile(path)
 		if err != nil {
 			return nil, err
 		}
-		if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
-			resp.Body.Close()
-			return nil, fmt.Errorf("HTTP status %d", resp.StatusCode)
+		var server serverConfig
+		if err := yaml.Unmarshal(data, &server); err != nil {
+			return nil, fmt.Errorf("can't parse server config %s: %w", path, err)
 		}
-		return resp.Body, nil
+		if len(server.Name) == 0 {
+			server.Name = strings.TrimSuffix(filepath.Base(path), ext)
+		}
+		log.Println("Loaded server config:", path)
+		servers = append(servers, server)
 	}
+	return servers, nil
 }
 
-// Scrapes stats using the previous fetch
-func (e *Exporter) scrape() {
-	e.totalScrapes.Inc()
+type Exporter struct {
+	URI   string
+	mutex sync.RWMutex
+	fetch func(ctx context.Context, cmd string, params url.Values) (io.ReadCloser, error)
 
-	body, err := e.fetch()
-	if err != nil {
-		e.up.Set(0)
-		fmt.Errorf("Can't scrape Tautulli: %v", err)
-		return
-	}
-	defer body.Close()
+	// The last scrape's metrics, /metrics/lite serves them again unless it already has
+	lastScrape       []prometheus.Metric
+	lastScrapeServed bool
 
-	// If we got data, we're up
-	e.up.Set(1)
+	// Converts bandwidth from kbps into the configured unit
+	bandwidthFactor float64
 
-	// Read in the bytes from our body for use in our json parser
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(body)
+	// Ignores the residual bandwidth Tautulli sometimes reports with nothing playing
+	zeroIdleBandwidth bool
 
-	data := gjson.GetBytes(buf.Bytes(), "response.data")
+	// Headroom is only exported when WAN_BANDWIDTH_CAP_KBPS is set
+	wanBandwidthCap      float64
+	wanBandwidthHeadroom *trackedGaugeVec
 
-	e.streamTotal.Set(data.Get("stream_count").Float())
-	e.streamTranscode.Set(data.Get("stream_count_transcode").Float())
-	e.streamDirectPlay.Set(data.Get("stream_count_direct_play").Float())
-	e.streamDirectStream.Set(data.Get("stream_count_direct_stream").Float())
+	// Limits requests to Tautulli when TAUTULLI_MAX_RPS is set
+	limiter *rate.Limiter
+	timeout time.Duration
 
-	e.bandwidthTotal.Set(data.Get("total_bandwidth").Float())
-	e.bandwidthLan.Set(data.Get("lan_bandwidth").Float())
-	e.bandwidthWan.Set(data.Get("wan_bandwidth").Float())
+	// Collectors still running past the scrape deadline are abandoned, and waited for before the next scrape
+	scrapeTimeout time.Duration
+	scrapeCtx     context.Context
+	pending       sync.WaitGroup
 
-}
+	up, streamTotal, streamTranscode, streamDirectPlay, streamDirectStream, bandwidthTotal, bandwidthLan, bandwidthWan           prometheus.Gauge
+	transcodeRatio, startTime, syncItemsActive, librarySections, longPausedSessions, streamingActive, stalledSessions            prometheus.Gauge
+	streamCountMax, usersTotal, usersWatching, usersWatchingRatio                                                                prometheus.Gauge
+	averageStreamBitrate, transcodeHwSessions, highBitrateStreams, subtitleBurnSessions, downscaleSessions, relayLimitedSessions prometheus.Gauge
+	transcodeOverload, averageProgress, distinctTitles, wanBandwidthRatio, directPlaySessions, distinctStreamIPs                 prometheus.Gauge
+	totalScrapes, playsTotal, throttledRequests, bufferingEvents, directPlayMismatches, streamSeconds, tlsVerifyFailures         prometheus.Counter
+	newslettersSent, newslettersFailed                                                                                           prometheus.Counter
+	parseErrors, collectorErrors, collectorTimeouts, pmsConnectionEvents, invalidResponses                                       *prometheus.CounterVec
+	collectorUp                                                                                                                  *trackedGaugeVec
+	scrapeDuration                                                                                                               prometheus.Histogram
+	streamMetrics, bandwidthMetrics                                                                                              map[string]*prometheus.GaugeVec
 
-// Resets metrics to 0
-func (e *Exporter) resetMetrics() {
-	e.streamTotal.Set(0)
-	e.streamTranscode.Set(0)
-	e.streamDirectPlay.Set(0)
-	e.streamDirectStream.Set(0)
-	e.bandwidthTotal.Set(0)
-	e.bandwidthLan.Set(0)
-	e.bandwidthWan.Set(0)
+	// METRIC_SCHEMA=v2 adds consistently named stream and bandwidth metrics next to the old ones
+	schemaV2                               bool
+	streamsByDecision, bandwidthByLocation *trackedGaugeVec
+
+	// Per-session metrics keyed by the session field they are read from or derived from
+	sessionMetrics map[string]*trackedGaugeVec
+
+	// Gauges configured with CUSTOM_METRICS
+	customMetrics []customMetric
+
+	// Every labeled metric, so series that disappear get cleaned up
+	trackedMetrics  []*trackedGaugeVec
+	zeroStaleSeries bool
+
+	// Metrics with a label per user or session are only filled in when SESSION_METRICS is on
+	sessionDetail         bool
+	userDistinctPlatforms *trackedGaugeVec
+	sessionContainerInfo  *trackedGaugeVec
+	transcodesByPlatform  *trackedGaugeVec
+	streamCountByPlayer   *trackedGaugeVec
+
+	homeStats                                           map[string]bool
+	homeStatsCount                                      int
+	homeStatPlays, homeStatDuration, homeStatConcurrent *trackedGaugeVec
+
+	// Optional collectors that are enabled
+	collectors map[string]bool
+
+	streamCountBySecure, streamCountByLibrary, streamCountByLocation, streamCountByAudio *trackedGaugeVec
+
+	// History row count from the previous scrape, used to increment playsTotal
+	lastHistoryTotal float64
+
+	// Whether Tautulli was connected to Plex on the previous scrape, nil until the first one
+	lastPmsConnected *bool
+
+	// Only exported when the server_status collector ran and Tautulli reported its connection state
+	pmsReachable *trackedGaugeVec
+
+	// Newest newsletter log entry already counted, -1 until the first scrape
+	lastNewsletterID int64
+
+	// Session states from the previous scrape, keyed by session_key
+	sessionStates map[string]string
+
+	// When each paused session was first seen paused, keyed by session_key
+	pausedSince    map[string]time.Time
+	longPauseAfter time.Duration
+
+	// Playback positions of the sessions that were playing in the previous scrape and when they last moved, keyed by session_key
+	viewOffsets map[string]viewOffset
+	stallAfter  time.Duration
+
+	// When duplicate session keys were last logged
+	duplicateSessionsLogged time.Time
+
+	// More transcodes than this sets transcodeOverload
+	transcodeAlert float64
+
+	// Sessions streaming above this bitrate in kbps are counted in highBitrateStreams
+	highBitrate float64
+
+	// User counts from the current scrape, used for usersWatchingRatio
+	watchingUsers, registeredUsers float64
+
+	// Only set when STREAM_COUNT_WINDOW is, activity is also sampled between scrapes to catch short streams
+	streamSampler          *streamSampler
+	streamCountWindowedMax prometheus.Gauge
+
+	// Only set when STREAM_COUNT_INTERVAL_STATS is, summarizes the samples between two scrapes
+	streamStats                                                            *streamStats
+	streamCountIntervalMin, streamCountIntervalMax, streamCountIntervalAvg prometheus.Gauge
+
+	// Highest stream count seen since startup or since the last reset, if a reset interval is set
+	maxStreams        float64
+	maxStreamsSince   time.Time
+	maxStreamsResetIn time.Duration
+
+	// Per-user watch time needs a call per user, so it's refreshed in the background
+	userStatsMutex       sync.Mutex
+	userStatsDays        int
+	userStatsConcurrency int
+	userWatchTime        map[string]float64
+	userStatsErr         error
+	userWatchTimeSeconds *trackedGaugeVec
+
+	versionInfo *trackedGaugeVec
+
+	// Only exported for libraries Tautulli reports a scan status for
+	libraryScanning *trackedGaugeVec
+
+	// Field presence is only filled in when DEBUG_METRICS is on
+	debugMetrics         bool
+	responseFieldPresent *trackedGaugeVec
+
+	// Set once at startup, so it isn't reset like the other labeled metrics
+	targetInfo *prometheus.GaugeVec
+
+	// Keeps the last result for each command, including ones from the background refresh
+	commandPermitted  *prometheus.GaugeVec
+	lastResponseBytes *prometheus.GaugeVec
+
+	// Plex host resources are only exported when Tautulli reports them
+	pmsCpuPercent, pmsMemoryBytes *trackedGaugeVec
+
+	// Only exported when Tautulli reports its configured base URL
+	baseURLMatches *trackedGaugeVec
+
+	// Only exported when Tautulli has recently added items
+	secondsSinceLastAdded *trackedGaugeVec
+
+	// Only exported when activity could be scraped, counts from the exporter's start until the first stream
+	secondsSinceLastStream *trackedGaugeVec
+	lastStreamAt           time.Time
+
+	// When activity was last scraped, zero until the first scrape and after a failed one
+	lastActivityAt time.Time
+
+	// Only exported when Plex has a transcode limit set, availability needs the transcode count from activity
+	transcodeLimit, transcodesAvailable *trackedGaugeVec
+	transcodeCount, transcodeLimitValue float64
 }
 
-func main() {
-	if len(version) == 0 {
-		version = "dev"
+var (
+	version string
+)
+
+func NewExporter(uri string, cfg config, constLabels prometheus.Labels) (*Exporter, error) {
+	headers, err := parseHeaders(cfg.ExtraHeaders)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.AcceptLanguage) > 0 {
+		headers.Set("Accept-Language", cfg.AcceptLanguage)
 	}
 
-	log.Println("Tautulli exporter version:", version)
+	bandwidthFactor, ok := bandwidthUnits[cfg.BandwidthUnit]
+	if !ok {
+		return nil, fmt.Errorf("unknown bandwidth unit %q, expected kbps, bps or Bps", cfg.BandwidthUnit)
+	}
 
-	cfg := config{}
-	err := env.Parse(&cfg)
-	if err != nil {
-		fmt.Printf("%+v\n", err)
+	if cfg.MetricSchema != "v1" && cfg.MetricSchema != "v2" {
+		return nil, fmt.Errorf("unknown metric schema %q, expected v1 or v2", cfg.MetricSchema)
 	}
 
-	if len(cfg.TautulliApiKey) == 0 {
-		log.Fatal("No API key set")
+	if cfg.EmptySeriesMode != "remove" && cfg.EmptySeriesMode != "zero" {
+		return nil, fmt.Errorf("unknown empty series mode %q, expected remove or zero", cfg.EmptySeriesMode)
 	}
 
-	log.Println("Tautulli Scrape URI:", cfg.TautulliScrapeUri)
-	log.Println("Tautulli SSL verify:", strconv.FormatBool(cfg.TautulliSslVerify))
-	log.Println("Tautulli Timeout:", cfg.TautulliTimeout)
-	log.Println("Tautulli API key:", cfg.TautulliApiKey)
+	if (cfg.StreamWindow > 0 || cfg.StreamStats) && cfg.StreamSampleEvery <= 0 {
+		return nil, fmt.Errorf("stream sample interval has to be positive, got %s", cfg.StreamSampleEvery)
+	}
 
-	u, err := url.Parse(cfg.TautulliScrapeUri + "/api/v2")
-	if err != nil {
-		log.Fatal(err)
+	for i := 1; i < len(cfg.ScrapeBuckets); i++ {
+		if cfg.ScrapeBuckets[i] <= cfg.ScrapeBuckets[i-1] {
+			return nil, fmt.Errorf("scrape duration buckets have to be in increasing order, got %v", cfg.ScrapeBuckets)
+		}
 	}
 
-	q := u.Query()
-	q.Set("apikey", cfg.TautulliApiKey)
-	q.Set("cmd", "get_activity")
-	u.RawQuery = q.Encode()
+	if cfg.UserStatsConcurrency < 1 {
+		return nil, fmt.Errorf("user stats concurrency has to be at least 1, got %d", cfg.UserStatsConcurrency)
+	}
 
-	exporter, err := NewExporter(u.String(), cfg.TautulliSslVerify, cfg.TautulliTimeout)
+	// Also used for plain HTTP URIs, a proxy in front of Tautulli can redirect them to HTTPS
+	tlsConfig, err := newTLSConfig(cfg.TautulliSslVerify, cfg.TautulliCaFile, cfg.MinTLSVersion)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	prometheus.MustRegister(exporter)
 
-	// Expose the registered metrics via HTTP.
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-			<head><title>Tautulli Exporter</title></head>
-			<body>
-			<h1>Tautulli Exporter</h1>
-			<p><a href="/metrics">Metrics</a></p>
-			<p>Version: ` + version + `</p>
-			</body>
-			</html>`))
+	var fetch = fetchHTTP(uri, tlsConfig, cfg.TautulliTimeout, cfg.FollowRedirects, headers)
+	if len(cfg.FileSource) > 0 {
+		fetch = fetchFile(cfg.FileSource)
+	}
+
+	// Fetched once, before any metric is built, since const labels can't change later.
+	// The label is always added, every server's metrics need the same labels to be registered together.
+	if cfg.MachineIDLabel {
+		machineID, err := fetchMachineIdentifier(fetch)
+		if err != nil {
+			log.Printf("Can't get the Plex machine identifier, leaving the machine_identifier label empty: %v", err)
+		}
+		labels := prometheus.Labels{"machine_identifier": machineID}
+		for name, value := range constLabels {
+			labels[name] = value
+		}
+		constLabels = labels
+	}
+
+	var selectedSessionMetrics map[string]*trackedGaugeVec
+	if cfg.SessionMetrics {
+		selectedSessionMetrics = map[string]*trackedGaugeVec{
+			"progress_percent":  newSessionMetric("progress_percent", cfg.help("session_progress_percent", "Playback progress of the session in percent."), constLabels),
+			"bandwidth":         newSessionMetric("bandwidth_kbps", cfg.help("session_bandwidth_kbps", "Bandwidth Plex reserved for the session in kbps."), constLabels),
+			"stream_bitrate":    newSessionMetric("bitrate_kbps", cfg.help("session_bitrate_kbps", "Bitrate of the session's stream in kbps."), constLabels),
+			"transcode_hw":      newSessionMetric("transcode_hw", cfg.help("session_transcode_hw", "Whether the session is transcoding with hardware acceleration."), constLabels),
+			"remaining_seconds": newSessionMetric("remaining_seconds", cfg.help("session_remaining_seconds", "Time left until the session finishes playing."), constLabels),
+			"subtitle_burn":     newSessionMetric("subtitle_burn", cfg.help("session_subtitle_burn", "Whether the session is burning subtitles into the video."), constLabels),
+			"relay_limited":     newSessionMetric("relay_limited", cfg.help("session_relay_limited", "Whether the session goes through the Plex relay and its source is above the relay's bitrate cap."), constLabels),
+		}
+	}
+
+	startTime := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "exporter_start_time_seconds",
+		Help:        cfg.help("exporter_start_time_seconds", "Unix time the exporter was started at."),
+		ConstLabels: constLabels,
 	})
-	log.Println("Serving /metrics on port", cfg.ServePort)
-	log.Fatal(http.ListenAndServe(":"+cfg.ServePort, nil))
+	startTime.Set(float64(time.Now().Unix()))
+
+	parsedURI, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	targetInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "target_info",
+		Help:        cfg.help("target_info", "Tautulli URL the exporter scrapes with the API key removed, the value is always 1."),
+		ConstLabels: constLabels,
+	}, []string{"uri"})
+	targetInfo.WithLabelValues(redactURL(parsedURI)).Set(1)
+
+	homeStats := make(map[string]bool)
+	for _, statID := range cfg.HomeStats {
+		statID = strings.TrimSpace(statID)
+		if _, ok := homeStatNameFields[statID]; !ok {
+			log.Println("Skipping unknown home stat:", statID)
+			continue
+		}
+		homeStats[statID] = true
+	}
+
+	collectors := make(map[string]bool)
+	for _, name := range cfg.Collectors {
+		name = strings.TrimSpace(name)
+		if !isAvailableCollector(name) {
+			log.Println("Skipping unknown collector:", name)
+			continue
+		}
+		collectors[name] = true
+	}
+
+	customMetrics := parseCustomMetrics(cfg.CustomMetrics, constLabels)
+
+	var limiter *rate.Limiter
+	if cfg.MaxRPS > 0 {
+		limiter = rate.NewLimiter(rate.Limit(cfg.MaxRPS), 1)
+	}
+
+	e := &Exporter{
+		URI:                  uri,
+		fetch:                fetch,
+		limiter:              limiter,
+		bandwidthFactor:      bandwidthFactor,
+		zeroIdleBandwidth:    cfg.ZeroIdleBandwidth,
+		wanBandwidthCap:      cfg.WanBandwidthCap,
+		timeout:              cfg.TautulliTimeout,
+		scrapeTimeout:        cfg.ScrapeTimeout,
+		scrapeCtx:            context.Background(),
+		lastNewsletterID:     -1,
+		lastStreamAt:         time.Now(),
+		longPauseAfter:       cfg.LongPauseAfter,
+		stallAfter:           cfg.StallAfter,
+		highBitrate:          cfg.HighBitrate,
+		transcodeAlert:       cfg.TranscodeAlert,
+		maxStreamsSince:      time.Now(),
+		maxStreamsResetIn:    cfg.StreamMaxReset,
+		sessionMetrics:       selectedSessionMetrics,
+		schemaV2:             cfg.MetricSchema == "v2",
+		zeroStaleSeries:      cfg.EmptySeriesMode == "zero",
+		customMetrics:        customMetrics,
+		sessionDetail:        cfg.SessionMetrics,
+		debugMetrics:         cfg.DebugMetrics,
+		homeStats:            homeStats,
+		homeStatsCount:       cfg.HomeStatsCount,
+		collectors:           collectors,
+		userStatsDays:        cfg.UserStatsDays,
+		userStatsConcurrency: cfg.UserStatsConcurrency,
+		startTime:            startTime,
+		targetInfo:           targetInfo,
+		commandPermitted: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "command_permitted",
+			Help:        cfg.help("command_permitted", "Was the API key allowed to run each command the last time it was called"),
+			ConstLabels: constLabels,
+		}, []string{"command"}),
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "up",
+			Help:        cfg.help("up", "Was the last scrape of Tautulli successful"),
+			ConstLabels: constLabels,
+		}),
+		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "exporter_total_scrapes",
+			Help:        cfg.help("exporter_total_scrapes", "Current total Tautulli scrapes"),
+			ConstLabels: constLabels,
+		}),
+		throttledRequests: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "exporter_throttled_requests_total",
+			Help:        cfg.help("exporter_throttled_requests_total", "Number of requests to Tautulli that had to wait for the rate limit."),
+			ConstLabels: constLabels,
+		}),
+		lastResponseBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "last_response_bytes",
+			Help:        cfg.help("last_response_bytes", "Size of the last successful response from Tautulli, by command."),
+			ConstLabels: constLabels,
+		}, []string{"command"}),
+		scrapeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "exporter_scrape_duration_seconds",
+			Help:        cfg.help("exporter_scrape_duration_seconds", "Time it took to scrape Tautulli."),
+			ConstLabels: constLabels,
+			Buckets:     cfg.ScrapeBuckets,
+		}),
+		collectorUp: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "collector_up",
+			Help:        cfg.help("collector_up", "Was the last scrape of each collector successful"),
+			ConstLabels: constLabels,
+		}, []string{"collector"}),
+		collectorErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "collector_errors_total",
+			Help:        cfg.help("collector_errors_total", "Number of failed scrapes for each collector."),
+			ConstLabels: constLabels,
+		}, []string{"collector"}),
+		collectorTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "collector_timeouts_total",
+			Help:        cfg.help("collector_timeouts_total", "Number of scrapes where each collector didn't finish before SCRAPE_TIMEOUT."),
+			ConstLabels: constLabels,
+		}, []string{"collector"}),
+		invalidResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "invalid_responses_total",
+			Help:        cfg.help("invalid_responses_total", "Number of responses from Tautulli that were incomplete or not JSON, by command."),
+			ConstLabels: constLabels,
+		}, []string{"command"}),
+		parseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "scrape_parse_errors_total",
+			Help:        cfg.help("scrape_parse_errors_total", "Number of times an expected field was missing from a Tautulli response."),
+			ConstLabels: constLabels,
+		}, []string{"field"}),
+		streamTotal: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stream_count",
+			Help:        cfg.help("stream_count", "Number of total streams."),
+			ConstLabels: constLabels,
+		}),
+		directPlaySessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "direct_play_sessions",
+			Help:        cfg.help("direct_play_sessions", "Number of sessions whose transcode decision is direct play."),
+			ConstLabels: constLabels,
+		}),
+		streamingActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "streaming_active",
+			Help:        cfg.help("streaming_active", "Whether anything is currently streaming."),
+			ConstLabels: constLabels,
+		}),
+		subtitleBurnSessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "subtitle_burn_sessions",
+			Help:        cfg.help("subtitle_burn_sessions", "Number of sessions burning subtitles into the video."),
+			ConstLabels: constLabels,
+		}),
+		relayLimitedSessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "relay_limited_sessions",
+			Help:        cfg.help("relay_limited_sessions", "Number of sessions held back by the Plex relay's bitrate cap."),
+			ConstLabels: constLabels,
+		}),
+		downscaleSessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "downscale_sessions",
+			Help:        cfg.help("downscale_sessions", "Number of sessions transcoding the video to a lower resolution than the source."),
+			ConstLabels: constLabels,
+		}),
+		highBitrateStreams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "high_bitrate_streams",
+			Help:        cfg.help("high_bitrate_streams", "Number of sessions streaming above HIGH_BITRATE_THRESHOLD_KBPS."),
+			ConstLabels: constLabels,
+		}),
+		transcodeHwSessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transcode_hw_sessions",
+			Help:        cfg.help("transcode_hw_sessions", "Number of transcoding sessions using hardware acceleration."),
+			ConstLabels: constLabels,
+		}),
+		distinctTitles: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "distinct_titles",
+			Help:        cfg.help("distinct_titles", "Number of different titles being watched, episodes of the same show count once."),
+			ConstLabels: constLabels,
+		}),
+		distinctStreamIPs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "distinct_stream_ips",
+			Help:        cfg.help("distinct_stream_ips", "Number of different client IP addresses streaming."),
+			ConstLabels: constLabels,
+		}),
+		averageProgress: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "average_progress_percent",
+			Help:        cfg.help("average_progress_percent", "Mean playback progress of all active sessions in percent."),
+			ConstLabels: constLabels,
+		}),
+		averageStreamBitrate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "average_stream_bitrate_kbps",
+			Help:        cfg.help("average_stream_bitrate_kbps", "Mean bitrate of all active sessions in kbps."),
+			ConstLabels: constLabels,
+		}),
+		streamsByDecision: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "streams",
+			Help:        cfg.help("streams", "Number of streams by transcode decision."),
+			ConstLabels: constLabels,
+		}, []string{"decision"}),
+		bandwidthByLocation: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "bandwidth_kbps",
+			Help:        cfg.help("bandwidth_kbps", "Bandwidth utilized in kbps by location."),
+			ConstLabels: constLabels,
+		}, []string{"location"}),
+		wanBandwidthHeadroom: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "wan_bandwidth_headroom_kbps",
+			Help:        cfg.help("wan_bandwidth_headroom_kbps", "WAN bandwidth left before reaching WAN_BANDWIDTH_CAP_KBPS."),
+			ConstLabels: constLabels,
+		}, nil),
+		streamCountMax: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stream_count_max",
+			Help:        cfg.help("stream_count_max", "Highest number of total streams seen since the exporter started or the max was last reset."),
+			ConstLabels: constLabels,
+		}),
+		streamTranscode: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stream_count_transcode",
+			Help:        cfg.help("stream_count_transcode", "Number of streams that are transcoding."),
+			ConstLabels: constLabels,
+		}),
+		streamDirectPlay: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stream_direct_play",
+			Help:        cfg.help("stream_direct_play", "Number of streams that are direct_plays."),
+			ConstLabels: constLabels,
+		}),
+		streamDirectStream: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stream_direct_stream",
+			Help:        cfg.help("stream_direct_stream", "Number of streams that are direct streams."),
+			ConstLabels: constLabels,
+		}),
+		transcodeRatio: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transcode_ratio",
+			Help:        cfg.help("transcode_ratio", "Ratio of transcoding streams to total streams."),
+			ConstLabels: constLabels,
+		}),
+		bandwidthTotal: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "bandwidth_total",
+			Help:        cfg.help("bandwidth_total", "Total bandwidth utilized in "+cfg.BandwidthUnit+"."),
+			ConstLabels: constLabels,
+		}),
+		bandwidthLan: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "bandwidth_lan",
+			Help:        cfg.help("bandwidth_lan", "LAN bandwidth utilized in "+cfg.BandwidthUnit+"."),
+			ConstLabels: constLabels,
+		}),
+		bandwidthWan: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "bandwidth_wan",
+			Help:        cfg.help("bandwidth_wan", "WAN bandwidth utilized in "+cfg.BandwidthUnit+"."),
+			ConstLabels: constLabels,
+		}),
+		wanBandwidthRatio: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "wan_bandwidth_ratio",
+			Help:        cfg.help("wan_bandwidth_ratio", "Ratio of WAN bandwidth to total bandwidth."),
+			ConstLabels: constLabels,
+		}),
+		streamCountBySecure: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stream_count_by_secure",
+			Help:        cfg.help("stream_count_by_secure", "Number of streams by whether the client connection is secure."),
+			ConstLabels: constLabels,
+		}, []string{"secure"}),
+		streamCountByLibrary: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stream_count_by_library",
+			Help:        cfg.help("stream_count_by_library", "Number of streams from each library."),
+			ConstLabels: constLabels,
+		}, []string{"section_name"}),
+		streamCountByLocation: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stream_count_by_location",
+			Help:        cfg.help("stream_count_by_location", "Number of streams by whether the client is on the local network."),
+			ConstLabels: constLabels,
+		}, []string{"location"}),
+		streamCountByAudio: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stream_count_by_audio_channels",
+			Help:        cfg.help("stream_count_by_audio_channels", "Number of streams by audio channel layout and whether the audio is transcoded."),
+			ConstLabels: constLabels,
+		}, []string{"layout", "audio_decision"}),
+		transcodeOverload: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transcode_overload",
+			Help:        cfg.help("transcode_overload", "Are there more transcodes than TRANSCODE_ALERT_THRESHOLD"),
+			ConstLabels: constLabels,
+		}),
+		pmsReachable: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "pms_reachable",
+			Help:        cfg.help("pms_reachable", "Is Tautulli's websocket to the Plex Media Server connected"),
+			ConstLabels: constLabels,
+		}, nil),
+		pmsConnectionEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "pms_connection_events_total",
+			Help:        cfg.help("pms_connection_events_total", "Number of times Tautulli was seen connecting to or disconnecting from Plex."),
+			ConstLabels: constLabels,
+		}, []string{"event"}),
+		tlsVerifyFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "tls_verify_failed_total",
+			Help:        cfg.help("tls_verify_failed_total", "Number of requests to Tautulli that failed because its certificate couldn't be verified."),
+			ConstLabels: constLabels,
+		}),
+		streamSeconds: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "stream_seconds_total",
+			Help:        cfg.help("stream_seconds_total", "Approximate number of seconds streamed, summed over all streams."),
+			ConstLabels: constLabels,
+		}),
+		directPlayMismatches: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "direct_play_mismatches_total",
+			Help:        cfg.help("direct_play_mismatches_total", "Number of scrapes where stream_count_direct_play didn't match the direct play sessions."),
+			ConstLabels: constLabels,
+		}),
+		bufferingEvents: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "buffering_events_total",
+			Help:        cfg.help("buffering_events_total", "Number of times a session started buffering."),
+			ConstLabels: constLabels,
+		}),
+		newslettersSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "newsletter_sent_total",
+			Help:        cfg.help("newsletter_sent_total", "Number of newsletters sent successfully since the exporter started."),
+			ConstLabels: constLabels,
+		}),
+		newslettersFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "newsletter_failed_total",
+			Help:        cfg.help("newsletter_failed_total", "Number of newsletters that failed to send since the exporter started."),
+			ConstLabels: constLabels,
+		}),
+		playsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "plays_total",
+			Help:        cfg.help("plays_total", "Total plays recorded in Tautulli's history."),
+			ConstLabels: constLabels,
+		}),
+		longPausedSessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "long_paused_sessions",
+			Help:        cfg.help("long_paused_sessions", "Number of sessions that have been paused for longer than the long pause threshold."),
+			ConstLabels: constLabels,
+		}),
+		stalledSessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stalled_sessions",
+			Help:        cfg.help("stalled_sessions", "Number of playing sessions whose position hasn't advanced for STALL_THRESHOLD."),
+			ConstLabels: constLabels,
+		}),
+		syncItemsActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "sync_items_active",
+			Help:        cfg.help("sync_items_active", "Number of synced items still waiting to be downloaded."),
+			ConstLabels: constLabels,
+		}),
+		librarySections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "library_sections_total",
+			Help:        cfg.help("library_sections_total", "Number of libraries configured in Plex."),
+			ConstLabels: constLabels,
+		}),
+		usersTotal: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "users_total",
+			Help:        cfg.help("users_total", "Number of users registered in Tautulli."),
+			ConstLabels: constLabels,
+		}),
+		usersWatching: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "users_watching",
+			Help:        cfg.help("users_watching", "Number of distinct users with an active session."),
+			ConstLabels: constLabels,
+		}),
+		usersWatchingRatio: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "users_watching_ratio",
+			Help:        cfg.help("users_watching_ratio", "Ratio of registered users that have an active session."),
+			ConstLabels: constLabels,
+		}),
+		sessionContainerInfo: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "session_container_info",
+			Help:        cfg.help("session_container_info", "Source and streamed container of each session, the value is always 1."),
+			ConstLabels: constLabels,
+		}, append(append([]string{}, sessionLabelNames...), "source", "target")),
+		userDistinctPlatforms: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "user_distinct_platforms",
+			Help:        cfg.help("user_distinct_platforms", "Number of different platforms each user is currently streaming from."),
+			ConstLabels: constLabels,
+		}, []string{"user"}),
+		transcodesByPlatform: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transcode_count_by_platform",
+			Help:        cfg.help("transcode_count_by_platform", "Number of transcoding sessions for each client platform."),
+			ConstLabels: constLabels,
+		}, []string{"platform"}),
+		streamCountByPlayer: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stream_count_by_player",
+			Help:        cfg.help("stream_count_by_player", "Number of streams from each player."),
+			ConstLabels: constLabels,
+		}, []string{"player"}),
+		versionInfo: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "version_info",
+			Help:        cfg.help("version_info", "Version of Tautulli, the value is always 1."),
+			ConstLabels: constLabels,
+		}, []string{"version"}),
+		libraryScanning: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "library_scanning",
+			Help:        cfg.help("library_scanning", "Whether Plex is currently scanning the library."),
+			ConstLabels: constLabels,
+		}, []string{"section_name"}),
+		responseFieldPresent: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "response_field_present",
+			Help:        cfg.help("response_field_present", "Whether the field was in the last get_activity response."),
+			ConstLabels: constLabels,
+		}, []string{"field"}),
+		baseURLMatches: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "base_url_matches_target",
+			Help:        cfg.help("base_url_matches_target", "Whether Tautulli's configured base URL matches the URL the exporter scrapes."),
+			ConstLabels: constLabels,
+		}, nil),
+		pmsCpuPercent: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "pms_cpu_percent",
+			Help:        cfg.help("pms_cpu_percent", "CPU utilization of the Plex Media Server host in percent."),
+			ConstLabels: constLabels,
+		}, nil),
+		pmsMemoryBytes: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "pms_memory_bytes",
+			Help:        cfg.help("pms_memory_bytes", "Memory used on the Plex Media Server host in bytes."),
+			ConstLabels: constLabels,
+		}, nil),
+		secondsSinceLastAdded: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "seconds_since_last_added",
+			Help:        cfg.help("seconds_since_last_added", "Time since the newest item was added to Plex."),
+			ConstLabels: constLabels,
+		}, nil),
+		secondsSinceLastStream: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "seconds_since_last_stream",
+			Help:        cfg.help("seconds_since_last_stream", "Time since anything was last streaming, 0 while something is."),
+			ConstLabels: constLabels,
+		}, nil),
+		transcodeLimit: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transcode_sessions_limit",
+			Help:        cfg.help("transcode_sessions_limit", "Maximum number of simultaneous transcodes Plex allows."),
+			ConstLabels: constLabels,
+		}, nil),
+		transcodesAvailable: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transcode_sessions_available",
+			Help:        cfg.help("transcode_sessions_available", "Number of transcodes that can still start before reaching Plex's limit."),
+			ConstLabels: constLabels,
+		}, nil),
+		homeStatPlays: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "home_stat_plays",
+			Help:        cfg.help("home_stat_plays", "Total plays for each row of the selected home stats."),
+			ConstLabels: constLabels,
+		}, homeStatLabelNames),
+		homeStatDuration: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "home_stat_duration_seconds",
+			Help:        cfg.help("home_stat_duration_seconds", "Total watch time for each row of the selected home stats."),
+			ConstLabels: constLabels,
+		}, homeStatLabelNames),
+		homeStatConcurrent: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "home_stat_most_concurrent",
+			Help:        cfg.help("home_stat_most_concurrent", "Most concurrent streams from the home stats."),
+			ConstLabels: constLabels,
+		}, []string{"name"}),
+		userWatchTimeSeconds: newTrackedGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "user_watch_time_seconds",
+			Help:        cfg.help("user_watch_time_seconds", "Total watch time of each user over the configured number of days."),
+			ConstLabels: constLabels,
+		}, []string{"user"}),
+	}
+
+	e.trackedMetrics = []*trackedGaugeVec{
+		e.collectorUp,
+		e.streamsByDecision,
+		e.bandwidthByLocation,
+		e.wanBandwidthHeadroom,
+		e.streamCountBySecure,
+		e.streamCountByLibrary,
+		e.streamCountByLocation,
+		e.streamCountByAudio,
+		e.userDistinctPlatforms,
+		e.transcodesByPlatform,
+		e.streamCountByPlayer,
+		e.sessionContainerInfo,
+		e.versionInfo,
+		e.libraryScanning,
+		e.responseFieldPresent,
+		e.pmsCpuPercent,
+		e.baseURLMatches,
+		e.secondsSinceLastAdded,
+		e.pmsReachable,
+		e.secondsSinceLastStream,
+		e.transcodeLimit,
+		e.transcodesAvailable,
+		e.pmsMemoryBytes,
+		e.homeStatPlays,
+		e.homeStatDuration,
+		e.homeStatConcurrent,
+		e.userWatchTimeSeconds,
+	}
+	for _, m := range e.sessionMetrics {
+		e.trackedMetrics = append(e.trackedMetrics, m)
+	}
+
+	// Create the per collector series up front so they're exported at 0 from the start instead of
+	// only appearing after the first error
+	e.up.Set(0)
+	names := []string{"activity"}
+	if len(homeStats) > 0 {
+		names = append(names, "home_stats")
+	}
+	for _, c := range availableCollectors {
+		if collectors[c.name] {
+			names = append(names, c.name)
+		}
+	}
+	for _, name := range names {
+		e.collectorUp.WithLabelValues(name).Set(0)
+		e.collectorErrors.WithLabelValues(name)
+		e.collectorTimeouts.WithLabelValues(name)
+	}
+
+	if cfg.StreamWindow > 0 {
+		e.streamSampler = newStreamSampler(cfg.StreamWindow)
+		e.streamCountWindowedMax = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stream_count_windowed_max",
+			Help:        cfg.help("stream_count_windowed_max", "Highest number of total streams seen over STREAM_COUNT_WINDOW."),
+			ConstLabels: constLabels,
+		})
+	}
+	if cfg.StreamStats {
+		e.streamStats = &streamStats{}
+		e.streamCountIntervalMin = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stream_count_interval_min",
+			Help:        cfg.help("stream_count_interval_min", "Lowest number of total streams sampled since the previous scrape."),
+			ConstLabels: constLabels,
+		})
+		e.streamCountIntervalMax = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stream_count_interval_max",
+			Help:        cfg.help("stream_count_interval_max", "Highest number of total streams sampled since the previous scrape."),
+			ConstLabels: constLabels,
+		})
+		e.streamCountIntervalAvg = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "stream_count_interval_avg",
+			Help:        cfg.help("stream_count_interval_avg", "Average number of total streams sampled since the previous scrape."),
+			ConstLabels: constLabels,
+		})
+	}
+	if e.streamSampler != nil || e.streamStats != nil {
+		go e.sampleStreams(cfg.StreamSampleEvery)
+	}
+
+	if collectors["user_watch_time"] {
+		go e.refreshUserWatchTime(cfg.UserStatsRefresh, cfg.UserStatsJitter)
+	}
+
+	return e, nil
+}
+
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- e.up.Desc()
+	ch <- e.totalScrapes.Desc()
+	ch <- e.startTime.Desc()
+	e.targetInfo.Describe(ch)
+	e.commandPermitted.Describe(ch)
+	ch <- e.throttledRequests.Desc()
+	ch <- e.tlsVerifyFailures.Desc()
+	ch <- e.scrapeDuration.Desc()
+	e.lastResponseBytes.Describe(ch)
+	e.parseErrors.Describe(ch)
+	e.invalidResponses.Describe(ch)
+	e.collectorUp.Describe(ch)
+	e.collectorErrors.Describe(ch)
+	e.collectorTimeouts.Describe(ch)
+	ch <- e.streamTotal.Desc()
+	ch <- e.streamingActive.Desc()
+	ch <- e.directPlaySessions.Desc()
+	ch <- e.streamCountMax.Desc()
+	if e.streamSampler != nil {
+		ch <- e.streamCountWindowedMax.Desc()
+	}
+	if e.streamStats != nil {
+		ch <- e.streamCountIntervalMin.Desc()
+		ch <- e.streamCountIntervalMax.Desc()
+		ch <- e.streamCountIntervalAvg.Desc()
+	}
+	for _, m := range e.customMetrics {
+		ch <- m.gauge.Desc()
+	}
+	ch <- e.streamTranscode.Desc()
+	ch <- e.streamDirectPlay.Desc()
+	ch <- e.streamDirectStream.Desc()
+	ch <- e.transcodeRatio.Desc()
+	ch <- e.transcodeOverload.Desc()
+	ch <- e.averageStreamBitrate.Desc()
+	ch <- e.averageProgress.Desc()
+	ch <- e.distinctTitles.Desc()
+	ch <- e.distinctStreamIPs.Desc()
+	ch <- e.transcodeHwSessions.Desc()
+	ch <- e.highBitrateStreams.Desc()
+	ch <- e.subtitleBurnSessions.Desc()
+	ch <- e.downscaleSessions.Desc()
+	ch <- e.relayLimitedSessions.Desc()
+	ch <- e.longPausedSessions.Desc()
+	ch <- e.stalledSessions.Desc()
+	ch <- e.bandwidthTotal.Desc()
+	ch <- e.bandwidthLan.Desc()
+	ch <- e.bandwidthWan.Desc()
+	ch <- e.wanBandwidthRatio.Desc()
+	e.wanBandwidthHeadroom.Describe(ch)
+	if e.schemaV2 {
+		e.streamsByDecision.Describe(ch)
+		e.bandwidthByLocation.Describe(ch)
+	}
+	e.streamCountBySecure.Describe(ch)
+	e.streamCountByLibrary.Describe(ch)
+	e.streamCountByLocation.Describe(ch)
+	e.streamCountByAudio.Describe(ch)
+	e.userDistinctPlatforms.Describe(ch)
+	e.transcodesByPlatform.Describe(ch)
+	e.streamCountByPlayer.Describe(ch)
+	e.sessionContainerInfo.Describe(ch)
+	ch <- e.syncItemsActive.Desc()
+	ch <- e.playsTotal.Desc()
+	ch <- e.newslettersSent.Desc()
+	ch <- e.newslettersFailed.Desc()
+	ch <- e.bufferingEvents.Desc()
+	ch <- e.directPlayMismatches.Desc()
+	ch <- e.streamSeconds.Desc()
+	e.pmsReachable.Describe(ch)
+	e.pmsConnectionEvents.Describe(ch)
+	ch <- e.librarySections.Desc()
+	ch <- e.usersTotal.Desc()
+	ch <- e.usersWatching.Desc()
+	ch <- e.usersWatchingRatio.Desc()
+	e.versionInfo.Describe(ch)
+	e.libraryScanning.Describe(ch)
+	e.responseFieldPresent.Describe(ch)
+	e.pmsCpuPercent.Describe(ch)
+	e.baseURLMatches.Describe(ch)
+	e.secondsSinceLastAdded.Describe(ch)
+	e.secondsSinceLastStream.Describe(ch)
+	e.transcodeLimit.Describe(ch)
+	e.transcodesAvailable.Describe(ch)
+	e.pmsMemoryBytes.Describe(ch)
+	for _, m := range e.sessionMetrics {
+		m.Describe(ch)
+	}
+	e.homeStatPlays.Describe(ch)
+	e.homeStatDuration.Describe(ch)
+	e.homeStatConcurrent.Describe(ch)
+	e.userWatchTimeSeconds.Describe(ch)
+}
+
+// Implements prometheus.Collector.
+// Resets the metrics, fetches stats, and provides the metrics.
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.mutex.Lock() // Protects metrics from concurrent collects.
+	defer e.mutex.Unlock()
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		e.collect(metrics)
+		close(metrics)
+	}()
+
+	// Kept with their current values for /metrics/lite, so it doesn't have to scrape Tautulli again
+	var snapshot []prometheus.Metric
+	for m := range metrics {
+		ch <- m
+		snapshot = append(snapshot, newSnapshotMetric(m))
+	}
+	e.lastScrape = snapshot
+	e.lastScrapeServed = false
+}
+
+// Scrapes Tautulli and sends every metric, the caller holds the mutex
+func (e *Exporter) collect(ch chan<- prometheus.Metric) {
+	e.pending.Wait()
+	e.resetMetrics()
+	e.scrape()
+	e.sweepMetrics()
+
+	ch <- e.up
+	ch <- e.totalScrapes
+	ch <- e.startTime
+	e.targetInfo.Collect(ch)
+	e.commandPermitted.Collect(ch)
+	ch <- e.throttledRequests
+	ch <- e.tlsVerifyFailures
+	ch <- e.scrapeDuration
+	e.lastResponseBytes.Collect(ch)
+	e.parseErrors.Collect(ch)
+	e.invalidResponses.Collect(ch)
+	e.collectorUp.Collect(ch)
+	e.collectorErrors.Collect(ch)
+	e.collectorTimeouts.Collect(ch)
+	ch <- e.streamTotal
+	ch <- e.streamingActive
+	ch <- e.directPlaySessions
+	ch <- e.streamCountMax
+	if e.streamSampler != nil {
+		ch <- e.streamCountWindowedMax
+	}
+	if e.streamStats != nil {
+		ch <- e.streamCountIntervalMin
+		ch <- e.streamCountIntervalMax
+		ch <- e.streamCountIntervalAvg
+	}
+	for _, m := range e.customMetrics {
+		ch <- m.gauge
+	}
+	ch <- e.streamTranscode
+	ch <- e.streamDirectPlay
+	ch <- e.streamDirectStream
+	ch <- e.transcodeRatio
+	ch <- e.transcodeOverload
+	ch <- e.averageStreamBitrate
+	ch <- e.averageProgress
+	ch <- e.distinctTitles
+	ch <- e.distinctStreamIPs
+	ch <- e.transcodeHwSessions
+	ch <- e.highBitrateStreams
+	ch <- e.subtitleBurnSessions
+	ch <- e.downscaleSessions
+	ch <- e.relayLimitedSessions
+	ch <- e.longPausedSessions
+	ch <- e.stalledSessions
+	ch <- e.bandwidthTotal
+	ch <- e.bandwidthLan
+	ch <- e.bandwidthWan
+	ch <- e.wanBandwidthRatio
+	e.wanBandwidthHeadroom.Collect(ch)
+	if e.schemaV2 {
+		e.streamsByDecision.Collect(ch)
+		e.bandwidthByLocation.Collect(ch)
+	}
+	e.streamCountBySecure.Collect(ch)
+	e.streamCountByLibrary.Collect(ch)
+	e.streamCountByLocation.Collect(ch)
+	e.streamCountByAudio.Collect(ch)
+	e.userDistinctPlatforms.Collect(ch)
+	e.transcodesByPlatform.Collect(ch)
+	e.streamCountByPlayer.Collect(ch)
+	e.sessionContainerInfo.Collect(ch)
+	ch <- e.syncItemsActive
+	ch <- e.playsTotal
+	ch <- e.newslettersSent
+	ch <- e.newslettersFailed
+	ch <- e.bufferingEvents
+	ch <- e.directPlayMismatches
+	ch <- e.streamSeconds
+	e.pmsReachable.Collect(ch)
+	e.pmsConnectionEvents.Collect(ch)
+	ch <- e.librarySections
+	ch <- e.usersTotal
+	ch <- e.usersWatching
+	ch <- e.usersWatchingRatio
+	e.versionInfo.Collect(ch)
+	e.libraryScanning.Collect(ch)
+	e.responseFieldPresent.Collect(ch)
+	e.pmsCpuPercent.Collect(ch)
+	e.baseURLMatches.Collect(ch)
+	e.secondsSinceLastAdded.Collect(ch)
+	e.secondsSinceLastStream.Collect(ch)
+	e.transcodeLimit.Collect(ch)
+	e.transcodesAvailable.Collect(ch)
+	e.pmsMemoryBytes.Collect(ch)
+	for _, m := range e.sessionMetrics {
+		m.Collect(ch)
+	}
+	e.homeStatPlays.Collect(ch)
+	e.homeStatDuration.Collect(ch)
+	e.homeStatConcurrent.Collect(ch)
+	e.userWatchTimeSeconds.Collect(ch)
+}
+
+// Exposes an exporter's metrics without the per-session, per-user, per-device and home stat series,
+// for scrapers that only need the aggregates
+type liteCollector struct {
+	exporter *Exporter
+	excluded map[*prometheus.Desc]bool
+}
+
+func newLiteCollector(e *Exporter) *liteCollector {
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		for _, m := range e.sessionMetrics {
+			m.Describe(descs)
+		}
+		e.sessionContainerInfo.Describe(descs)
+		e.userDistinctPlatforms.Describe(descs)
+		e.transcodesByPlatform.Describe(descs)
+		e.streamCountByPlayer.Describe(descs)
+		e.userWatchTimeSeconds.Describe(descs)
+		e.homeStatPlays.Describe(descs)
+		e.homeStatDuration.Describe(descs)
+		e.homeStatConcurrent.Describe(descs)
+		close(descs)
+	}()
+
+	excluded := make(map[*prometheus.Desc]bool)
+	for desc := range descs {
+		excluded[desc] = true
+	}
+	return &liteCollector{exporter: e, excluded: excluded}
+}
+
+func (c *liteCollector) Describe(ch chan<- *prometheus.Desc) {
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		c.exporter.Describe(descs)
+		close(descs)
+	}()
+	for desc := range descs {
+		if !c.excluded[desc] {
+			ch <- desc
+		}
+	}
+}
+
+// Serves the metrics from the last /metrics scrape, Tautulli is only scraped when there hasn't been one since the
+// previous request, so scraping both endpoints doesn't double the load or split the between-scrape state
+func (c *liteCollector) Collect(ch chan<- prometheus.Metric) {
+	e := c.exporter
+	e.mutex.Lock()
+	fresh := e.lastScrape != nil && !e.lastScrapeServed
+	e.mutex.Unlock()
+	if !fresh {
+		metrics := make(chan prometheus.Metric)
+		go func() {
+			e.Collect(metrics)
+			close(metrics)
+		}()
+		for range metrics {
+		}
+	}
+
+	e.mutex.Lock()
+	snapshot := e.lastScrape
+	e.lastScrapeServed = true
+	e.mutex.Unlock()
+	for _, m := range snapshot {
+		if !c.excluded[m.Desc()] {
+			ch <- m
+		}
+	}
+}
+
+// A metric's value from when it was collected, later scrapes don't change it
+type snapshotMetric struct {
+	desc   *prometheus.Desc
+	metric *dto.Metric
+}
+
+func newSnapshotMetric(m prometheus.Metric) prometheus.Metric {
+	metric := &dto.Metric{}
+	if err := m.Write(metric); err != nil {
+		return prometheus.NewInvalidMetric(m.Desc(), err)
+	}
+	return snapshotMetric{desc: m.Desc(), metric: metric}
+}
+
+func (m snapshotMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+func (m snapshotMetric) Write(out *dto.Metric) error {
+	out.Label = m.metric.Label
+	out.Gauge = m.metric.Gauge
+	out.Counter = m.metric.Counter
+	out.Summary = m.metric.Summary
+	out.Untyped = m.metric.Untyped
+	out.Histogram = m.metric.Histogram
+	out.TimestampMs = m.metric.TimestampMs
+	return nil
+}
+
+// Reports whether the Tautulli URI is served over HTTPS
+func usesTLS(uri string) bool {
+	return strings.HasPrefix(strings.ToLower(uri), "https://")
+}
+
+// Builds the TLS config for connecting to Tautulli, trusting caFile in addition to the system CAs when it's set
+func newTLSConfig(sslVerify bool, caFile string, minVersion string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: !sslVerify}
+	if len(minVersion) > 0 {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", minVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if len(caFile) == 0 {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
+
+// Reads responses from disk instead of Tautulli, for demos and testing without a live server.
+// A directory holds a <cmd>.json file per command, a single file is only used for get_activity.
+func fetchFile(path string) func(ctx context.Context, cmd string, params url.Values) (io.ReadCloser, error) {
+	return func(ctx context.Context, cmd string, params url.Values) (io.ReadCloser, error) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return os.Open(filepath.Join(path, cmd+".json"))
+		}
+		if cmd != "get_activity" {
+			return nil, fmt.Errorf("%s isn't available from file %s", cmd, path)
+		}
+		return os.Open(path)
+	}
+}
+
+// Fetches stats from Tautulli for later processing
+func fetchHTTP(uri string, tlsConfig *tls.Config, timeout time.Duration, followRedirects bool, headers http.Header) func(ctx context.Context, cmd string, params url.Values) (io.ReadCloser, error) {
+
+	// Starts from the default transport so HTTP_PROXY and its connection settings still apply
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	client := http.Client{
+		Timeout:   timeout,
+		Transport: tr,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// Redirects usually mean TAUTULLI_URI is wrong, so always make them visible
+			log.Println("Tautulli redirected", redactURL(via[len(via)-1].URL), "to", redactURL(req.URL))
+			if !followRedirects {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			return nil
+		},
+	}
+
+	return func(ctx context.Context, cmd string, params url.Values) (io.ReadCloser, error) {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+
+		q := u.Query()
+		q.Set("cmd", cmd)
+		for k, v := range params {
+			q[k] = v
+		}
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range headers {
+			req.Header[k] = v
+		}
+		req.Header.Set("User-Agent", userAgent)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			// Transport errors include the request URL, which has the API key in it
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				failed, parseErr := url.Parse(urlErr.URL)
+				if parseErr != nil {
+					failed = u
+				}
+				urlErr.URL = redactURL(failed)
+			}
+			return nil, err
+		}
+		if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+			resp.Body.Close()
+			return nil, &httpStatusError{statusCode: resp.StatusCode}
+		}
+		return resp.Body, nil
+	}
+}
+
+// Waits until the rate limit allows another request, giving up after the Tautulli timeout
+func (e *Exporter) waitForLimiter(ctx context.Context) error {
+	if e.limiter == nil || e.limiter.Allow() {
+		return nil
+	}
+
+	e.throttledRequests.Inc()
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	return e.limiter.Wait(ctx)
+}
+
+// Fetches a single Tautulli API command and returns the data from its response
+func (e *Exporter) fetchData(cmd string, params url.Values) (gjson.Result, error) {
+	return e.fetchDataContext(e.scrapeCtx, cmd, params)
+}
+
+// Like fetchData, but for calls outside of a scrape that shouldn't be cut short by its deadline
+func (e *Exporter) fetchDataContext(ctx context.Context, cmd string, params url.Values) (gjson.Result, error) {
+	if err := e.waitForLimiter(ctx); err != nil {
+		return gjson.Result{}, fmt.Errorf("waiting for the rate limit: %w", err)
+	}
+
+	body, err := e.fetch(ctx, cmd, params)
+	if err != nil {
+		if isTLSVerifyError(err) {
+			e.tlsVerifyFailures.Inc()
+		}
+		return gjson.Result{}, err
+	}
+	defer body.Close()
+
+	// Read in the bytes from our body for use in our json parser
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(body); err != nil {
+		e.invalidResponses.WithLabelValues(cmd).Inc()
+		return gjson.Result{}, fmt.Errorf("can't read %s response: %w", cmd, err)
+	}
+
+	// Proxies and Tautulli itself can send HTML error pages with a 200 status, and a
+	// connection that drops mid-response leaves a truncated body that gjson would partly parse
+	if !gjson.ValidBytes(buf.Bytes()) {
+		e.invalidResponses.WithLabelValues(cmd).Inc()
+		return gjson.Result{}, fmt.Errorf("%w from %s: %q", errInvalidResponse, cmd, truncate(buf.String(), 100))
+	}
+
+	// Tautulli reports errors like a bad API key in the response itself
+	response := gjson.GetBytes(buf.Bytes(), "response")
+	if result := response.Get("result").String(); result != "success" {
+		message := response.Get("message").String()
+		if isPermissionError(message) {
+			e.commandPermitted.WithLabelValues(cmd).Set(0)
+		}
+		return gjson.Result{}, &resultError{cmd: cmd, result: result, message: message}
+	}
+
+	e.commandPermitted.WithLabelValues(cmd).Set(1)
+	e.lastResponseBytes.WithLabelValues(cmd).Set(float64(buf.Len()))
+	return response.Get("data"), nil
+}
+
+// Returns the machine identifier of the Plex server behind Tautulli
+func fetchMachineIdentifier(fetch func(ctx context.Context, cmd string, params url.Values) (io.ReadCloser, error)) (string, error) {
+	body, err := fetch(context.Background(), "get_server_identity", nil)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(body); err != nil {
+		return "", fmt.Errorf("can't read get_server_identity response: %w", err)
+	}
+
+	response := gjson.GetBytes(buf.Bytes(), "response")
+	if result := response.Get("result").String(); result != "success" {
+		return "", &resultError{cmd: "get_server_identity", result: result, message: response.Get("message").String()}
+	}
+	machineID := response.Get("data.machine_identifier").String()
+	if len(machineID) == 0 {
+		return "", errors.New("get_server_identity didn't include a machine_identifier")
+	}
+	return machineID, nil
+}
+
+// Reports whether the request failed because Tautulli's certificate is expired, untrusted or for another host
+func isTLSVerifyError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname)
+}
+
+// Reports whether a Tautulli error message means the API key isn't allowed to run the command
+func isPermissionError(message string) bool {
+	message = strings.ToLower(message)
+	for _, s := range []string{"permission", "not allowed", "unauthorized", "forbidden", "invalid apikey"} {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Scrapes stats using the previous fetch
+func (e *Exporter) scrape() {
+	e.totalScrapes.Inc()
+
+	start := time.Now()
+	defer func() {
+		e.scrapeDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	// Without a deadline every collector is waited for
+	e.scrapeCtx = context.Background()
+	if e.scrapeTimeout > 0 {
+		ctx, cancel := context.WithTimeout(e.scrapeCtx, e.scrapeTimeout)
+		defer cancel()
+		e.scrapeCtx = ctx
+	}
+
+	e.watchingUsers = 0
+	e.registeredUsers = 0
+	e.transcodeCount = 0
+	e.transcodeLimitValue = 0
+
+	// up only reflects activity, the other collectors report their own status
+	activityOK := e.runCollector("activity", (*Exporter).scrapeActivity)
+	if activityOK {
+		e.up.Set(1)
+	} else {
+		e.up.Set(0)
+		// The streams during an outage or a timed out scrape aren't known, so the next scrape doesn't count them.
+		// A late activity response is dropped by runCollector, so it can't set this again.
+		e.lastActivityAt = time.Time{}
+	}
+
+	// Samples from between scrapes are still valid when this scrape's activity failed
+	if e.streamSampler != nil {
+		e.streamCountWindowedMax.Set(e.streamSampler.max(time.Now()))
+	}
+	if e.streamStats != nil {
+		min, max, avg := e.streamStats.take()
+		e.streamCountIntervalMin.Set(min)
+		e.streamCountIntervalMax.Set(max)
+		e.streamCountIntervalAvg.Set(avg)
+	}
+
+	if len(e.homeStats) > 0 {
+		e.runCollector("home_stats", (*Exporter).scrapeHomeStats)
+	}
+
+	usersOK, transcodeLimitOK := false, false
+	for _, c := range availableCollectors {
+		if e.collectors[c.name] {
+			ok := e.runCollector(c.name, c.scrape)
+			switch c.name {
+			case "users":
+				usersOK = ok
+			case "transcode_limit":
+				transcodeLimitOK = ok
+			}
+		}
+	}
+
+	if activityOK && transcodeLimitOK && e.transcodeLimitValue > 0 {
+		e.transcodesAvailable.WithLabelValues().Set(math.Max(e.transcodeLimitValue-e.transcodeCount, 0))
+	}
+
+	// Only set when both counts are from this scrape, a collector that missed the deadline leaves its count at 0
+	if activityOK && usersOK && e.registeredUsers > 0 {
+		e.usersWatchingRatio.Set(e.watchingUsers / e.registeredUsers)
+	}
+}
+
+// Fetches a collector's data and returns the function that updates the metrics and the exporter's state from it.
+// Only the fetch runs in the background, so a collector that misses the deadline can't change anything.
+type collector func(*Exporter) (func() error, error)
+
+// Runs a single collector and records whether it succeeded
+func (e *Exporter) runCollector(name string, scrape collector) bool {
+	type result struct {
+		update func() error
+		err    error
+	}
+	done := make(chan result, 1)
+	e.pending.Add(1)
+	go func() {
+		defer e.pending.Done()
+		update, err := scrape(e)
+		done <- result{update: update, err: err}
+	}()
+
+	var err error
+	select {
+	case r := <-done:
+		err = r.err
+		if err == nil {
+			err = r.update()
+		}
+	case <-e.scrapeCtx.Done():
+		e.collectorTimeouts.WithLabelValues(name).Inc()
+		err = fmt.Errorf("%w, didn't finish within %s", errScrapeTimeout, e.scrapeTimeout)
+	}
+
+	if err != nil {
+		log.Printf("Can't scrape Tautulli %s: %v", name, err)
+		e.collectorErrors.WithLabelValues(name).Inc()
+		e.collectorUp.WithLabelValues(name).Set(0)
+		return false
+	}
+	e.collectorUp.WithLabelValues(name).Set(1)
+	return true
+}
+
+// Samples the stream count every interval so streams shorter than the scrape interval are seen
+func (e *Exporter) sampleStreams(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		data, err := e.fetchDataContext(context.Background(), "get_activity", nil)
+		if err != nil {
+			log.Println("Can't sample Tautulli activity:", err)
+			continue
+		}
+		streamCount := data.Get("stream_count").Float()
+		if e.streamSampler != nil {
+			e.streamSampler.add(time.Now(), streamCount)
+		}
+		if e.streamStats != nil {
+			e.streamStats.add(streamCount)
+		}
+	}
+}
+
+// Raises the stream count high-water mark, starting over once the reset interval has passed
+func (e *Exporter) updateStreamCountMax(streamCount float64) {
+	if e.maxStreamsResetIn > 0 && time.Since(e.maxStreamsSince) >= e.maxStreamsResetIn {
+		e.maxStreams = 0
+		e.maxStreamsSince = time.Now()
+	}
+	if streamCount > e.maxStreams {
+		e.maxStreams = streamCount
+	}
+	e.streamCountMax.Set(e.maxStreams)
+}
+
+// Scrapes the current activity
+func (e *Exporter) scrapeActivity() (func() error, error) {
+	data, err := e.fetchData("get_activity", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		for _, field := range activityFields {
+			present := data.Get(field).Exists()
+			if !present {
+				e.parseErrors.WithLabelValues(field).Inc()
+			}
+			if e.debugMetrics {
+				value := 0.0
+				if present {
+					value = 1
+				}
+				e.responseFieldPresent.WithLabelValues(field).Set(value)
+			}
+		}
+
+		e.streamTotal.Set(data.Get("stream_count").Float())
+		e.streamTranscode.Set(data.Get("stream_count_transcode").Float())
+		e.streamDirectPlay.Set(data.Get("stream_count_direct_play").Float())
+		e.streamDirectStream.Set(data.Get("stream_count_direct_stream").Float())
+
+		// Avoid dividing by zero when nothing is playing
+		streamCount := data.Get("stream_count").Float()
+		if streamCount > 0 {
+			e.transcodeRatio.Set(data.Get("stream_count_transcode").Float() / streamCount)
+			e.streamingActive.Set(1)
+			e.lastStreamAt = time.Now()
+		}
+		e.secondsSinceLastStream.WithLabelValues().Set(time.Since(e.lastStreamAt).Seconds())
+
+		// Assumes the current streams were playing for the whole time since the previous scrape
+		now := time.Now()
+		if !e.lastActivityAt.IsZero() {
+			e.streamSeconds.Add(streamCount * now.Sub(e.lastActivityAt).Seconds())
+		}
+		e.lastActivityAt = now
+		e.updateStreamCountMax(streamCount)
+		if e.streamSampler != nil {
+			e.streamSampler.add(now, streamCount)
+		}
+		if e.streamStats != nil {
+			e.streamStats.add(streamCount)
+		}
+
+		e.transcodeCount = data.Get("stream_count_transcode").Float()
+		if e.transcodeCount > e.transcodeAlert {
+			e.transcodeOverload.Set(1)
+		}
+
+		// Tautulli reports bandwidth in kbps
+		totalBandwidth := data.Get("total_bandwidth").Float()
+		lanBandwidth := data.Get("lan_bandwidth").Float()
+		wanBandwidth := data.Get("wan_bandwidth").Float()
+		if e.zeroIdleBandwidth && streamCount == 0 {
+			totalBandwidth, lanBandwidth, wanBandwidth = 0, 0, 0
+		}
+		e.bandwidthTotal.Set(totalBandwidth * e.bandwidthFactor)
+		e.bandwidthLan.Set(lanBandwidth * e.bandwidthFactor)
+		e.bandwidthWan.Set(wanBandwidth * e.bandwidthFactor)
+		if totalBandwidth > 0 {
+			e.wanBandwidthRatio.Set(wanBandwidth / totalBandwidth)
+		}
+
+		if e.wanBandwidthCap > 0 {
+			e.wanBandwidthHeadroom.WithLabelValues().Set(math.Max(e.wanBandwidthCap-wanBandwidth, 0))
+		}
+
+		// The v2 names carry their unit, so they're always in kbps regardless of BANDWIDTH_UNIT
+		if e.schemaV2 {
+			e.streamsByDecision.WithLabelValues("transcode").Set(data.Get("stream_count_transcode").Float())
+			e.streamsByDecision.WithLabelValues("direct_play").Set(data.Get("stream_count_direct_play").Float())
+			e.streamsByDecision.WithLabelValues("direct_stream").Set(data.Get("stream_count_direct_stream").Float())
+			e.bandwidthByLocation.WithLabelValues("lan").Set(lanBandwidth)
+			e.bandwidthByLocation.WithLabelValues("wan").Set(wanBandwidth)
+		}
+
+		for _, m := range e.customMetrics {
+			m.gauge.Set(data.Get(m.path).Float())
+		}
+
+		sessions, duplicates := dedupeSessions(data.Get("sessions").Array())
+		if duplicates > 0 && time.Since(e.duplicateSessionsLogged) >= duplicateSessionLogEvery {
+			log.Printf("Tautulli listed %d sessions more than once, only the last entry for each session_key is used", duplicates)
+			e.duplicateSessionsLogged = time.Now()
+		}
+		e.scrapeSessions(sessions)
+
+		// Both come from the same response, so a difference means Tautulli's aggregate and session details disagree
+		directPlay := countDirectPlay(sessions)
+		e.directPlaySessions.Set(directPlay)
+		if directPlay != data.Get("stream_count_direct_play").Float() {
+			e.directPlayMismatches.Inc()
+		}
+		return nil
+	}, nil
+}
+
+// Drops all but the last entry for each session_key, Tautulli can list a session twice while it changes state
+func dedupeSessions(sessions []gjson.Result) ([]gjson.Result, int) {
+	deduped := make([]gjson.Result, 0, len(sessions))
+	seen := make(map[string]int)
+	for _, session := range sessions {
+		key := session.Get("session_key").String()
+		if i, ok := seen[key]; ok && len(key) > 0 {
+			deduped[i] = session
+			continue
+		}
+		seen[key] = len(deduped)
+		deduped = append(deduped, session)
+	}
+	return deduped, len(sessions) - len(deduped)
+}
+
+// Counts the sessions that play the file as is, without a direct stream or transcode
+func countDirectPlay(sessions []gjson.Result) float64 {
+	count := 0.0
+	for _, session := range sessions {
+		if session.Get("transcode_decision").String() == "direct play" {
+			count++
+		}
+	}
+	return count
+}
+
+// A session's playback position and when it was first seen at it
+type viewOffset struct {
+	offset    float64
+	changedAt time.Time
+}
+
+// Scrapes the per-session metrics and the aggregates derived from sessions
+func (e *Exporter) scrapeSessions(sessions []gjson.Result) {
+	userPlatforms := make(map[string]map[string]bool)
+	states := make(map[string]string)
+	pausedSince := make(map[string]time.Time)
+	viewOffsets := make(map[string]viewOffset)
+	now := time.Now()
+
+	watching := make(map[string]bool)
+	titles := make(map[string]bool)
+	ips := make(map[string]bool)
+	totalBitrate, totalProgress := 0.0, 0.0
+	for _, session := range sessions {
+		e.streamCountBySecure.WithLabelValues(labelOrUnknown(session.Get("secure").String())).Inc()
+		e.streamCountByLibrary.WithLabelValues(labelOrUnknown(session.Get("library_name").String())).Inc()
+		e.streamCountByLocation.WithLabelValues(labelOrUnknown(session.Get("location").String())).Inc()
+		e.streamCountByAudio.WithLabelValues(
+			labelOrUnknown(session.Get("audio_channel_layout").String()),
+			labelOrUnknown(session.Get("audio_decision").String()),
+		).Inc()
+		watching[session.Get("user").String()] = true
+		titles[sessionTitle(session)] = true
+		// Only counted, the addresses themselves are never exported
+		if ip := session.Get("ip_address").String(); len(ip) > 0 {
+			ips[ip] = true
+		}
+		totalProgress += session.Get("progress_percent").Float()
+		bitrate := session.Get("stream_bitrate").Float()
+		totalBitrate += bitrate
+		if bitrate > e.highBitrate {
+			e.highBitrateStreams.Inc()
+		}
+		if sessionTranscodeHw(session) == 1 {
+			e.transcodeHwSessions.Inc()
+		}
+		if sessionSubtitleBurn(session) == 1 {
+			e.subtitleBurnSessions.Inc()
+		}
+		if sessionDownscaled(session) {
+			e.downscaleSessions.Inc()
+		}
+		if sessionRelayLimited(session) == 1 {
+			e.relayLimitedSessions.Inc()
+		}
+
+		// Tautulli only reports the current state, so count sessions that went into buffering since the last scrape
+		sessionKey := session.Get("session_key").String()
+		state := session.Get("state").String()
+		if state == "buffering" && e.sessionStates[sessionKey] != "buffering" {
+			e.bufferingEvents.Inc()
+		}
+		states[sessionKey] = state
+
+		if state == "paused" {
+			since, ok := e.pausedSince[sessionKey]
+			if !ok {
+				since = now
+			}
+			pausedSince[sessionKey] = since
+			if now.Sub(since) > e.longPauseAfter {
+				e.longPausedSessions.Inc()
+			}
+		}
+
+		// Frozen streams are still reported as playing, but their position stops moving.
+		// Plex only updates the position every few seconds, so it has to stay put for a while.
+		if state == "playing" {
+			offset := viewOffset{offset: session.Get("view_offset").Float(), changedAt: now}
+			if last, ok := e.viewOffsets[sessionKey]; ok && offset.offset == last.offset {
+				offset.changedAt = last.changedAt
+				if now.Sub(offset.changedAt) >= e.stallAfter {
+					e.stalledSessions.Inc()
+				}
+			}
+			viewOffsets[sessionKey] = offset
+		}
+
+		if e.sessionDetail {
+			user := session.Get("user").String()
+			if userPlatforms[user] == nil {
+				userPlatforms[user] = make(map[string]bool)
+			}
+			userPlatforms[user][session.Get("platform").String()] = true
+
+			e.streamCountByPlayer.WithLabelValues(labelOrUnknown(session.Get("player").String())).Inc()
+			if session.Get("transcode_decision").String() == "transcode" {
+				e.transcodesByPlatform.WithLabelValues(labelOrUnknown(session.Get("platform").String())).Inc()
+			}
+
+			// session_key is Plex's numeric key for the session, session_id is its string identifier
+			labels := []string{
+				sessionKey,
+				session.Get("session_id").String(),
+				session.Get("user").String(),
+			}
+			for field, m := range e.sessionMetrics {
+				m.WithLabelValues(labels...).Set(sessionValue(session, field))
+			}
+
+			// A different target container means Plex is remuxing or transcoding the session
+			e.sessionContainerInfo.WithLabelValues(append(labels,
+				labelOrUnknown(session.Get("container").String()),
+				labelOrUnknown(session.Get("stream_container").String()),
+			)...).Set(1)
+		}
+	}
+
+	e.sessionStates = states
+	e.pausedSince = pausedSince
+	e.viewOffsets = viewOffsets
+
+	e.distinctTitles.Set(float64(len(titles)))
+	e.distinctStreamIPs.Set(float64(len(ips)))
+	e.watchingUsers = float64(len(watching))
+	e.usersWatching.Set(e.watchingUsers)
+
+	// Stays at 0 when nothing is playing
+	if len(sessions) > 0 {
+		e.averageStreamBitrate.Set(totalBitrate / float64(len(sessions)))
+		e.averageProgress.Set(totalProgress / float64(len(sessions)))
+	}
+
+	// One user streaming from several platforms at once is a good sign of a shared account
+	for user, platforms := range userPlatforms {
+		e.userDistinctPlatforms.WithLabelValues(user).Set(float64(len(platforms)))
+	}
+}
+
+// Returns the value of a session field, computing it if it's derived
+func sessionValue(session gjson.Result, field string) float64 {
+	if derive, ok := derivedSessionFields[field]; ok {
+		return derive(session)
+	}
+	return session.Get(field).Float()
+}
+
+// Reports 1 if either side of the session's transcode is using hardware acceleration
+func sessionTranscodeHw(session gjson.Result) float64 {
+	for _, field := range []string{"transcode_hw_decoding", "transcode_hw_encoding", "transcode_hw_full_pipeline"} {
+		if session.Get(field).Int() == 1 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Returns how much of the session is left to play, Tautulli reports both fields in milliseconds
+func sessionRemainingSeconds(session gjson.Result) float64 {
+	remaining := session.Get("duration").Float() - session.Get("view_offset").Float()
+	if remaining < 0 {
+		return 0
+	}
+	return remaining / 1000
+}
+
+// Returns the show or album for episodes and tracks, and the full title for everything else
+func sessionTitle(session gjson.Result) string {
+	if title := session.Get("grandparent_title").String(); len(title) > 0 {
+		return title
+	}
+	return session.Get("full_title").String()
+}
+
+// Reports 1 if Plex is burning subtitles into the video, which image based subtitles always need
+func sessionSubtitleBurn(session gjson.Result) float64 {
+	if session.Get("stream_subtitle_decision").String() == "burn" || session.Get("subtitle_decision").String() == "burn" {
+		return 1
+	}
+	return 0
+}
+
+// Reports 1 if the session goes through the Plex relay with a source the relay can't stream at full quality
+func sessionRelayLimited(session gjson.Result) float64 {
+	if session.Get("relayed").Bool() && session.Get("bitrate").Float() > relayBitrateLimit {
+		return 1
+	}
+	return 0
+}
+
+// Reports whether Plex is transcoding the video to a lower resolution than the source
+func sessionDownscaled(session gjson.Result) bool {
+	source, target := session.Get("height").Float(), session.Get("stream_video_height").Float()
+	if source == 0 || target == 0 {
+		source = resolutionHeights[strings.ToLower(session.Get("video_resolution").String())]
+		target = resolutionHeights[strings.ToLower(session.Get("stream_video_resolution").String())]
+	}
+	return target > 0 && target < source
+}
+
+// Scrapes the selected home stats
+func (e *Exporter) scrapeHomeStats() (func() error, error) {
+	params := url.Values{}
+	params.Set("stats_count", strconv.Itoa(e.homeStatsCount))
+
+	// A single stat can be asked for by itself, several are cheaper in one call and filtered below
+	if len(e.homeStats) == 1 {
+		for statID := range e.homeStats {
+			params.Set("stat_id", statID)
+		}
+	}
+
+	data, err := e.fetchData("get_home_stats", params)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		for _, stat := range data.Array() {
+			statID := stat.Get("stat_id").String()
+			if !e.homeStats[statID] {
+				continue
+			}
+
+			for _, row := range stat.Get("rows").Array() {
+				name := row.Get(homeStatNameFields[statID]).String()
+
+				// most_concurrent rows carry a stream count instead of play totals
+				if statID == "most_concurrent" {
+					e.homeStatConcurrent.WithLabelValues(name).Set(row.Get("count").Float())
+					continue
+				}
+
+				e.homeStatPlays.WithLabelValues(statID, name).Set(row.Get("total_plays").Float())
+				e.homeStatDuration.WithLabelValues(statID, name).Set(row.Get("total_duration").Float())
+			}
+		}
+		return nil
+	}, nil
+}
+
+// Scrapes the synced items and counts the ones still downloading
+func (e *Exporter) scrapeSync() (func() error, error) {
+	data, err := e.fetchData("get_synced_items", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		var active float64
+		for _, item := range data.Array() {
+			remaining := item.Get("item_count").Float() - item.Get("item_downloaded_count").Float()
+			if remaining > 0 {
+				active += remaining
+			}
+		}
+		e.syncItemsActive.Set(active)
+		return nil
+	}, nil
+}
+
+// Scrapes the Plex server info, skipping any host resource fields that aren't reported
+func (e *Exporter) scrapeServer() (func() error, error) {
+	data, err := e.fetchData("get_server_info", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		if cpu := data.Get("host_cpu_utilization"); cpu.Exists() {
+			e.pmsCpuPercent.WithLabelValues().Set(cpu.Float())
+		}
+		if memory := data.Get("host_memory_usage"); memory.Exists() {
+			e.pmsMemoryBytes.WithLabelValues().Set(memory.Float())
+		}
+		return nil
+	}, nil
+}
+
+// Scrapes whether Tautulli's configured base URL matches the URL the exporter scrapes, nothing is reported when it isn't set
+func (e *Exporter) scrapeBaseURL() (func() error, error) {
+	// The base URL is a Tautulli setting in the General section, get_server_info only has Plex's own info
+	params := url.Values{}
+	params.Set("key", "General")
+
+	data, err := e.fetchData("get_settings", params)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		if baseURL := data.Get("http_base_url").String(); len(baseURL) > 0 {
+			matches := 0.0
+			if sameBaseURL(baseURL, e.URI) {
+				matches = 1
+			}
+			e.baseURLMatches.WithLabelValues().Set(matches)
+		}
+		return nil
+	}, nil
+}
+
+// Reports whether target is on the same scheme and host as baseURL, and under its path
+func sameBaseURL(baseURL string, target string) bool {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return false
+	}
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(base.Scheme, parsed.Scheme) &&
+		strings.EqualFold(base.Host, parsed.Host) &&
+		strings.HasPrefix(parsed.Path, strings.TrimSuffix(base.Path, "/"))
+}
+
+// Scrapes the history row count and adds any new plays to playsTotal
+func (e *Exporter) scrapeHistory() (func() error, error) {
+	// Only the row count is needed, so ask for a single row
+	params := url.Values{}
+	params.Set("length", "1")
+
+	data, err := e.fetchData("get_history", params)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		total := data.Get("recordsTotal").Float()
+		if total > e.lastHistoryTotal {
+			e.playsTotal.Add(total - e.lastHistoryTotal)
+		}
+		// History shrinks when rows are deleted, so later plays are counted from the smaller total
+		e.lastHistoryTotal = total
+		return nil
+	}, nil
+}
+
+// Scrapes the newsletter log and counts the newsletters sent since the last scrape
+func (e *Exporter) scrapeNewsletters() (func() error, error) {
+	params := url.Values{}
+	params.Set("order_column", "timestamp")
+	params.Set("order_dir", "desc")
+	params.Set("length", "100")
+
+	data, err := e.fetchData("get_newsletter_log", params)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		newestID := e.lastNewsletterID
+		for _, entry := range data.Get("data").Array() {
+			id := entry.Get("id").Int()
+			if id > newestID {
+				newestID = id
+			}
+
+			// The first scrape only finds where the log is up to
+			if e.lastNewsletterID < 0 || id <= e.lastNewsletterID {
+				continue
+			}
+
+			if entry.Get("success").Int() == 1 {
+				e.newslettersSent.Inc()
+			} else {
+				e.newslettersFailed.Inc()
+			}
+		}
+		if newestID < 0 {
+			newestID = 0
+		}
+		e.lastNewsletterID = newestID
+		return nil
+	}, nil
+}
+
+// Scrapes how long ago the newest item was added, nothing is reported when there are no items
+func (e *Exporter) scrapeRecentlyAdded() (func() error, error) {
+	params := url.Values{}
+	params.Set("count", "1")
+
+	data, err := e.fetchData("get_recently_added", params)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		// added_at is a Unix timestamp, sent as a string
+		var newest int64
+		for _, item := range data.Get("recently_added").Array() {
+			if addedAt := item.Get("added_at").Int(); addedAt > newest {
+				newest = addedAt
+			}
+		}
+		if newest > 0 {
+			e.secondsSinceLastAdded.WithLabelValues().Set(time.Since(time.Unix(newest, 0)).Seconds())
+		}
+		return nil
+	}, nil
+}
+
+// Scrapes whether Tautulli is connected to Plex, and counts changes since the previous scrape
+func (e *Exporter) scrapeServerStatus() (func() error, error) {
+	data, err := e.fetchData("server_status", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		// Tautulli's connected flag follows its websocket to Plex, which is what live activity comes from.
+		// Without it the state is unknown, which mustn't look like a lost connection.
+		field := data.Get("connected")
+		if !field.Exists() {
+			return nil
+		}
+		connected := field.Bool()
+		reachable := 0.0
+		if connected {
+			reachable = 1
+		}
+		e.pmsReachable.WithLabelValues().Set(reachable)
+		if e.lastPmsConnected != nil && *e.lastPmsConnected != connected {
+			if connected {
+				e.pmsConnectionEvents.WithLabelValues("connected").Inc()
+			} else {
+				e.pmsConnectionEvents.WithLabelValues("disconnected").Inc()
+			}
+		}
+		e.lastPmsConnected = &connected
+		return nil
+	}, nil
+}
+
+// Scrapes Plex's limit on simultaneous transcodes, 0 means there's no limit so nothing is reported
+func (e *Exporter) scrapeTranscodeLimit() (func() error, error) {
+	params := url.Values{}
+	params.Set("pref", "TranscodeCountLimit")
+
+	data, err := e.fetchData("get_server_pref", params)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		if limit := data.Float(); limit > 0 {
+			e.transcodeLimitValue = limit
+			e.transcodeLimit.WithLabelValues().Set(limit)
+		}
+		return nil
+	}, nil
+}
+
+// Scrapes the number of users registered in Tautulli
+func (e *Exporter) scrapeUsers() (func() error, error) {
+	data, err := e.fetchData("get_users", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		e.registeredUsers = float64(len(data.Array()))
+		e.usersTotal.Set(e.registeredUsers)
+		return nil
+	}, nil
+}
+
+// Scrapes the libraries configured in Plex
+func (e *Exporter) scrapeLibraries() (func() error, error) {
+	data, err := e.fetchData("get_libraries", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		e.librarySections.Set(float64(len(data.Array())))
+
+		// Plex calls a running scan refreshing, Tautulli versions that don't pass it on are skipped
+		for _, library := range data.Array() {
+			refreshing := library.Get("refreshing")
+			if !refreshing.Exists() {
+				continue
+			}
+			scanning := 0.0
+			if refreshing.Bool() {
+				scanning = 1
+			}
+			e.libraryScanning.WithLabelValues(labelOrUnknown(library.Get("section_name").String())).Set(scanning)
+		}
+		return nil
+	}, nil
+}
+
+// Scrapes Tautulli's own version, older versions without get_tautulli_info are skipped
+func (e *Exporter) scrapeTautulliInfo() (func() error, error) {
+	data, err := e.fetchData("get_tautulli_info", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		if version := data.Get("tautulli_version"); version.Exists() {
+			e.versionInfo.WithLabelValues(version.String()).Set(1)
+		}
+		return nil
+	}, nil
+}
+
+// Reports the cached per-user watch time and any error from the last refresh
+func (e *Exporter) scrapeUserWatchTime() (func() error, error) {
+	e.userStatsMutex.Lock()
+	watchTime, err := e.userWatchTime, e.userStatsErr
+	e.userStatsMutex.Unlock()
+
+	// The previous values are still served when the last refresh failed
+	return func() error {
+		for user, seconds := range watchTime {
+			e.userWatchTimeSeconds.WithLabelValues(user).Set(seconds)
+		}
+		return err
+	}, nil
+}
+
+// Refreshes the per-user watch time every interval, plus a random delay of up to jitter
+// so several exporters pointed at the same Tautulli don't refresh at the same time
+func (e *Exporter) refreshUserWatchTime(interval time.Duration, jitter time.Duration) {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		e.updateUserWatchTime()
+		delay := interval
+		if jitter > 0 {
+			delay += time.Duration(random.Int63n(int64(jitter)))
+		}
+		time.Sleep(delay)
+	}
+}
+
+// Fetches the watch time of every user and replaces the cached values
+func (e *Exporter) updateUserWatchTime() {
+	users, err := e.fetchDataContext(context.Background(), "get_users", nil)
+
+	// Keep serving the previous values, but report the failure on the next scrape
+	e.userStatsMutex.Lock()
+	e.userStatsErr = err
+	e.userStatsMutex.Unlock()
+	if err != nil {
+		return
+	}
+
+	// Only USER_STATS_CONCURRENCY users are looked up at a time, so large servers don't flood Tautulli
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	watchTime := make(map[string]float64)
+	pending := make(chan gjson.Result)
+	for i := 0; i < e.userStatsConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for user := range pending {
+				params := url.Values{}
+				params.Set("query_days", strconv.Itoa(e.userStatsDays))
+				params.Set("user_id", user.Get("user_id").String())
+				stats, err := e.fetchDataContext(context.Background(), "get_user_watch_time_stats", params)
+				if err != nil {
+					log.Println("Can't scrape Tautulli watch time for user", user.Get("friendly_name").String()+":", err)
+					continue
+				}
+				mutex.Lock()
+				watchTime[user.Get("friendly_name").String()] = stats.Get("0.total_time").Float()
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, user := range users.Array() {
+		pending <- user
+	}
+	close(pending)
+	wg.Wait()
+
+	e.userStatsMutex.Lock()
+	e.userWatchTime = watchTime
+	e.userStatsMutex.Unlock()
+}
+
+// Resets metrics to 0
+func (e *Exporter) resetMetrics() {
+	e.streamTotal.Set(0)
+	e.streamTranscode.Set(0)
+	e.streamDirectPlay.Set(0)
+	e.streamDirectStream.Set(0)
+	e.transcodeRatio.Set(0)
+	e.streamingActive.Set(0)
+	e.directPlaySessions.Set(0)
+	e.transcodeOverload.Set(0)
+	e.averageStreamBitrate.Set(0)
+	e.averageProgress.Set(0)
+	e.distinctTitles.Set(0)
+	e.distinctStreamIPs.Set(0)
+	e.transcodeHwSessions.Set(0)
+	e.highBitrateStreams.Set(0)
+	e.subtitleBurnSessions.Set(0)
+	e.downscaleSessions.Set(0)
+	e.relayLimitedSessions.Set(0)
+	e.longPausedSessions.Set(0)
+	e.stalledSessions.Set(0)
+	e.bandwidthTotal.Set(0)
+	e.bandwidthLan.Set(0)
+	e.bandwidthWan.Set(0)
+	e.wanBandwidthRatio.Set(0)
+	e.syncItemsActive.Set(0)
+	e.librarySections.Set(0)
+	e.usersTotal.Set(0)
+	e.usersWatching.Set(0)
+	e.usersWatchingRatio.Set(0)
+	for _, m := range e.customMetrics {
+		m.gauge.Set(0)
+	}
+	for _, m := range e.trackedMetrics {
+		m.reset()
+	}
+}
+
+// Removes labeled series that weren't seen in the last scrape
+func (e *Exporter) sweepMetrics() {
+	for _, m := range e.trackedMetrics {
+		m.sweep(e.zeroStaleSeries)
+	}
+}
+
+// Parses Key:Value pairs into headers for requests to Tautulli
+func parseHeaders(pairs []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			return nil, fmt.Errorf("invalid header %q, expected Key:Value", pair)
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return headers, nil
+}
+
+// Parses name=path pairs into gauges, skipping invalid ones with a warning.
+// Paths point into the get_activity response, so they have to start with response.data.
+func parseCustomMetrics(defs []string, constLabels prometheus.Labels) []customMetric {
+	var customMetrics []customMetric
+	seen := make(map[string]bool)
+	for _, def := range defs {
+		parts := strings.SplitN(def, "=", 2)
+		if len(parts) != 2 {
+			log.Printf("Skipping custom metric %q, expected name=path", def)
+			continue
+		}
+		name := strings.TrimSpace(parts[0])
+		path := strings.TrimSpace(parts[1])
+		if !customMetricName.MatchString(name) || seen[name] {
+			log.Printf("Skipping custom metric %q, the name is invalid or already used", def)
+			continue
+		}
+		if !strings.HasPrefix(path, "response.data.") || len(path) == len("response.data.") {
+			log.Printf("Skipping custom metric %q, the path has to start with response.data.", def)
+			continue
+		}
+		seen[name] = true
+		customMetrics = append(customMetrics, customMetric{
+			path: strings.TrimPrefix(path, "response.data."),
+			gauge: prometheus.NewGauge(prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Subsystem:   "custom",
+				Name:        name,
+				Help:        fmt.Sprintf("Value of %s in the get_activity response.", path),
+				ConstLabels: constLabels,
+			}),
+		})
+	}
+	return customMetrics
+}
+
+// Builds the API URL for a Tautulli server, with the API key either as the apikey
+// query parameter or as a path segment for proxies that authenticate on the path
+func apiURL(baseURI string, apiKey string, keyInPath bool) (string, error) {
+	if keyInPath {
+		u, err := url.Parse(baseURI + "/api/v2/" + url.PathEscape(apiKey))
+		if err != nil {
+			return "", err
+		}
+		return u.String(), nil
+	}
+
+	u, err := url.Parse(baseURI + "/api/v2")
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("apikey", apiKey)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Returns the URL with the API key removed so it's safe to log
+func redactURL(u *url.URL) string {
+	redacted := *u
+	q := redacted.Query()
+	q.Del("apikey")
+	redacted.RawQuery = q.Encode()
+	if i := strings.Index(redacted.Path, "/api/v2/"); i >= 0 {
+		redacted.Path = redacted.Path[:i] + "/api/v2/REDACTED"
+		redacted.RawPath = ""
+	}
+	return redacted.String()
+}
+
+// Returns only the last 4 characters of an API key so it's safe to log, short keys aren't shown at all
+func redactAPIKey(key string) string {
+	if len(key) == 0 {
+		return "<not set>"
+	}
+	if len(key) < 16 {
+		return "<redacted>"
+	}
+	return "..." + key[len(key)-4:]
+}
+
+// Shortens s to at most n bytes for logging
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// Buckets missing label values as unknown
+func labelOrUnknown(value string) string {
+	if len(value) == 0 {
+		return "unknown"
+	}
+	return value
+}
+
+// Reports whether name is one of the optional collectors
+func isAvailableCollector(name string) bool {
+	for _, c := range availableCollectors {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Scrapes the exporters immediately and responds with the values as JSON instead of the Prometheus format
+func scrapeHandler(exporters []prometheus.Collector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Use POST to trigger a scrape", http.StatusMethodNotAllowed)
+			return
+		}
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(exporters...)
+		families, err := registry.Gather()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(flattenMetrics(families))
+	}
+}
+
+// Flattens gathered metrics into a map of name{labels} to value
+func flattenMetrics(families []*dto.MetricFamily) map[string]float64 {
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			var labels string
+			if len(m.GetLabel()) > 0 {
+				pairs := make([]string, 0, len(m.GetLabel()))
+				for _, label := range m.GetLabel() {
+					pairs = append(pairs, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+				}
+				labels = "{" + strings.Join(pairs, ",") + "}"
+			}
+			name := family.GetName()
+
+			switch {
+			case m.GetGauge() != nil:
+				values[name+labels] = m.GetGauge().GetValue()
+			case m.GetCounter() != nil:
+				values[name+labels] = m.GetCounter().GetValue()
+			case m.GetUntyped() != nil:
+				values[name+labels] = m.GetUntyped().GetValue()
+			case m.GetHistogram() != nil:
+				values[name+"_count"+labels] = float64(m.GetHistogram().GetSampleCount())
+				values[name+"_sum"+labels] = m.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	return values
+}
+
+// Serves metrics in InfluxDB line protocol when requested with ?format=influx, otherwise uses next
+func influxHandler(gatherer prometheus.Gatherer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") != "influx" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		families, err := gatherer.Gather()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeInflux(w, families, time.Now())
+	})
+}
+
+// Writes each metric as a line with the metric name as the measurement and the labels as tags
+func writeInflux(w io.Writer, families []*dto.MetricFamily, now time.Time) {
+	escaper := strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			series := escaper.Replace(family.GetName())
+			for _, label := range m.GetLabel() {
+				series += "," + escaper.Replace(label.GetName()) + "=" + escaper.Replace(label.GetValue())
+			}
+
+			var fields string
+			switch {
+			case m.GetGauge() != nil:
+				fields = "value=" + strconv.FormatFloat(m.GetGauge().GetValue(), 'g', -1, 64)
+			case m.GetCounter() != nil:
+				fields = "value=" + strconv.FormatFloat(m.GetCounter().GetValue(), 'g', -1, 64)
+			case m.GetUntyped() != nil:
+				fields = "value=" + strconv.FormatFloat(m.GetUntyped().GetValue(), 'g', -1, 64)
+			case m.GetHistogram() != nil:
+				fields = "count=" + strconv.FormatUint(m.GetHistogram().GetSampleCount(), 10) + "i" +
+					",sum=" + strconv.FormatFloat(m.GetHistogram().GetSampleSum(), 'g', -1, 64)
+			default:
+				continue
+			}
+
+			fmt.Fprintf(w, "%s %s %d\n", series, fields, now.UnixNano())
+		}
+	}
+}
+
+// Listens on a TCP address, or on a Unix socket when the address starts with unix:
+func listen(address string) (net.Listener, error) {
+	path := strings.TrimPrefix(address, "unix:")
+	if path == address {
+		return net.Listen("tcp", address)
+	}
+
+	// A socket left behind by an unclean shutdown would make the listen fail, anything else at the path is left alone
+	info, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	case info.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("can't listen on %s, it already exists and isn't a socket", path)
+	default:
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func main() {
+	if len(version) == 0 {
+		version = "dev"
+	}
+
+	configFile := flag.String("config.file", "", "Path to a YAML config file, environment variables override its values")
+	flag.Parse()
+
+	log.Println("Tautulli exporter version:", version)
+
+	cfg := config{}
+	// A value that doesn't parse would otherwise silently leave its setting empty
+	if err := env.Parse(&cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(*configFile) > 0 {
+		if err := loadConfigFile(*configFile, &cfg); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Loaded config file:", *configFile)
+	}
+
+	if len(cfg.ConfigDir) > 0 {
+		servers, err := loadServerDir(cfg.ConfigDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(servers) == 0 {
+			log.Println("WARNING: No server configs found in", cfg.ConfigDir)
+		}
+		cfg.Servers = append(cfg.Servers, servers...)
+	}
+
+	log.Println("Tautulli follow redirects:", strconv.FormatBool(cfg.FollowRedirects))
+	for _, pair := range cfg.ExtraHeaders {
+		// Header values are often tokens, so only log the names
+		log.Println("Tautulli extra header:", strings.TrimSpace(strings.SplitN(pair, ":", 2)[0])+": <redacted>")
+	}
+	log.Println("Session metrics:", strconv.FormatBool(cfg.SessionMetrics))
+	log.Println("Home stats:", strings.Join(cfg.HomeStats, ","))
+	log.Println("Collectors:", strings.Join(cfg.Collectors, ","))
+
+	// Without servers in the config file there's a single server set up from the top level config
+	servers := cfg.Servers
+	if len(servers) == 0 {
+		servers = []serverConfig{{}}
+	}
+
+	// Metrics need the same labels on every server, so it's all or nothing for tenants
+	tenants := 0
+	for _, server := range cfg.Servers {
+		if len(server.Tenant) > 0 {
+			tenants++
+		}
+	}
+	if tenants > 0 && tenants != len(cfg.Servers) {
+		log.Fatal("Either every server in the config file needs a tenant or none of them")
+	}
+
+	// Only the exporters are registered here, without the Go runtime metrics or the per-session series
+	liteRegistry := prometheus.NewRegistry()
+	var exporters []prometheus.Collector
+	for _, server := range servers {
+		serverCfg := cfg.forServer(server)
+
+		var constLabels prometheus.Labels
+		if len(cfg.Servers) > 0 {
+			if len(server.Name) == 0 {
+				log.Fatal("Servers in the config file need a name")
+			}
+			constLabels = prometheus.Labels{"server": server.Name}
+			log.Println("Tautulli server:", server.Name)
+			if len(server.Tenant) > 0 {
+				constLabels["tenant"] = server.Tenant
+				log.Println("Tautulli tenant:", server.Tenant)
+			}
+		}
+
+		if len(serverCfg.FileSource) > 0 {
+			log.Println("Reading Tautulli responses from", serverCfg.FileSource)
+		}
+		if err := checkAPIKey(serverCfg); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println("Tautulli Scrape URI:", serverCfg.TautulliScrapeUri)
+		if usesTLS(serverCfg.TautulliScrapeUri) {
+			log.Println("Tautulli SSL verify:", strconv.FormatBool(serverCfg.TautulliSslVerify))
+			if !serverCfg.TautulliSslVerify {
+				log.Println("WARNING: Tautulli's certificate won't be verified, set TAUTULLI_CA_FILE instead of turning off TAUTULLI_SSL_VERIFY for self-signed certificates")
+			}
+			if len(serverCfg.TautulliCaFile) > 0 {
+				log.Println("Tautulli CA file:", serverCfg.TautulliCaFile)
+			}
+		}
+		log.Println("Tautulli Timeout:", serverCfg.TautulliTimeout)
+		log.Println("Tautulli API key:", redactAPIKey(serverCfg.TautulliApiKey))
+
+		uri, err := apiURL(serverCfg.TautulliScrapeUri, serverCfg.TautulliApiKey, serverCfg.ApiKeyInPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		exporter, err := NewExporter(uri, serverCfg, constLabels)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if serverCfg.StartupProbe {
+			if _, err := exporter.fetchData("get_activity", nil); err != nil {
+				log.Fatal("Startup probe failed: ", err)
+			}
+			log.Println("Startup probe succeeded")
+		}
+
+		prometheus.MustRegister(exporter)
+		liteRegistry.MustRegister(newLiteCollector(exporter))
+		exporters = append(exporters, exporter)
+	}
+
+	// Expose the registered metrics via HTTP.
+	var metricsHandler = promhttp.Handler()
+	if cfg.InfluxFormat {
+		metricsHandler = influxHandler(prometheus.DefaultGatherer, metricsHandler)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler)
+	mux.Handle("/metrics/lite", promhttp.HandlerFor(liteRegistry, promhttp.HandlerOpts{}))
+
+	// Admin endpoints get their own listener when ADMIN_LISTEN_ADDRESS is set, so the metrics port can be exposed on its own
+	adminMux := mux
+	if len(cfg.AdminAddress) > 0 {
+		adminMux = http.NewServeMux()
+	}
+	adminMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	if cfg.DebugEndpoints {
+		adminMux.HandleFunc("/scrape", scrapeHandler(exporters))
+		log.Println("Serving debug endpoint /scrape")
+	}
+
+	// Profiles are never served next to /metrics
+	if cfg.EnablePprof && len(cfg.AdminAddress) == 0 {
+		log.Println("WARNING: ENABLE_PPROF needs ADMIN_LISTEN_ADDRESS, not serving /debug/pprof/")
+	} else if cfg.EnablePprof {
+		adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+		adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		log.Println("Serving debug endpoint /debug/pprof/")
+	}
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html>
+			<head><title>Tautulli Exporter</title></head>
+			<body>
+			<h1>Tautulli Exporter</h1>
+			<p><a href="/metrics">Metrics</a></p>
+			<p><a href="/metrics/lite">Metrics without per-session series</a></p>
+			<p>Version: ` + version + `</p>
+			</body>
+			</html>`))
+	})
+
+	listenAddress := cfg.ListenAddress
+	if len(listenAddress) == 0 {
+		listenAddress = ":" + cfg.ServePort
+	}
+
+	listener, err := listen(listenAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := newHTTPServer(mux, cfg.WebIdleTimeout, cfg.WebWriteTimeout)
+	httpServers := []*http.Server{server}
+
+	if len(cfg.AdminAddress) > 0 {
+		adminListener, err := listen(cfg.AdminAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		adminServer := newHTTPServer(adminMux, cfg.WebIdleTimeout, cfg.WebWriteTimeout)
+		httpServers = append(httpServers, adminServer)
+
+		log.Println("Serving admin endpoints on", cfg.AdminAddress)
+		go func() {
+			if err := adminServer.Serve(adminListener); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// Shutting the servers down closes their listeners, which removes the socket files when listening on Unix sockets
+	shutdown := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		log.Println("Shutting down")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, s := range httpServers {
+			if err := s.Shutdown(ctx); err != nil {
+				log.Println("Can't shut down cleanly:", err)
+			}
+		}
+		close(shutdown)
+	}()
+
+	log.Println("Serving /metrics on", listenAddress)
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	// Serve returns as soon as shutdown starts, wait for the in-flight requests to finish
+	<-shutdown
+}
+
+// Timeouts keep slow clients from holding connections open, writeTimeout has to leave room for a slow scrape.
+// Cleartext HTTP/2 is served next to HTTP/1, the exporter never serves TLS itself.
+func newHTTPServer(handler http.Handler, idleTimeout time.Duration, writeTimeout time.Duration) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		Protocols:         protocols,
+	}
 }
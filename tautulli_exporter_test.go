@@ -0,0 +1,994 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caarlos0/env"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+// A get_activity response with a transcode over the WAN and a direct play on the LAN
+const busyActivity = `{"response": {"result": "success", "message": null, "data": {
+	"stream_count": "2", "stream_count_transcode": 1, "stream_count_direct_play": 1, "stream_count_direct_stream": 0,
+	"total_bandwidth": 3000, "lan_bandwidth": 1000, "wan_bandwidth": 2000,
+	"sessions": [
+		{"session_key": "1", "session_id": "a", "user": "alice", "state": "playing", "transcode_decision": "transcode",
+		 "location": "wan", "library_name": "Movies", "secure": "1", "audio_channel_layout": "5.1", "audio_decision": "transcode",
+		 "bandwidth": 2000, "stream_bitrate": 1800, "progress_percent": 10, "view_offset": 60000, "ip_address": "203.0.113.4",
+		 "player": "Living Room", "platform": "Roku", "container": "mkv", "stream_container": "mpegts"},
+		{"session_key": "2", "session_id": "b", "user": "bob", "state": "playing", "transcode_decision": "direct play",
+		 "location": "lan", "library_name": "TV Shows", "secure": "0", "audio_channel_layout": "stereo", "audio_decision": "direct play",
+		 "bandwidth": 1000, "stream_bitrate": 900, "progress_percent": 50, "view_offset": 120000, "ip_address": "10.0.0.2",
+		 "player": "Phone", "platform": "iOS", "container": "mp4", "stream_container": "mp4"}
+	]}}}`
+
+// A get_activity response with nothing playing
+const idleActivity = `{"response": {"result": "success", "message": null, "data": {
+	"stream_count": "0", "stream_count_transcode": 0, "stream_count_direct_play": 0, "stream_count_direct_stream": 0,
+	"total_bandwidth": 0, "lan_bandwidth": 0, "wan_bandwidth": 0, "sessions": []}}}`
+
+// Returns the config a bare environment would give, without home stats so only get_activity is called
+func testConfig(t *testing.T) config {
+	t.Helper()
+	var cfg config
+	if err := env.Parse(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.HomeStats = nil
+	return cfg
+}
+
+// Serves each command's response from responses, which can be changed between scrapes
+func fixtureFetch(responses map[string]string) func(ctx context.Context, cmd string, params url.Values) (io.ReadCloser, error) {
+	return func(ctx context.Context, cmd string, params url.Values) (io.ReadCloser, error) {
+		body, ok := responses[cmd]
+		if !ok {
+			return nil, fmt.Errorf("no fixture for %s", cmd)
+		}
+		return io.NopCloser(strings.NewReader(body)), nil
+	}
+}
+
+// Builds an exporter that reads its responses from responses instead of calling Tautulli
+func newTestExporter(t *testing.T, cfg config, responses map[string]string) *Exporter {
+	t.Helper()
+	e, err := NewExporter("http://127.0.0.1:8181/api/v2?apikey=secret", cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.fetch = fixtureFetch(responses)
+	return e
+}
+
+// Runs a scrape and returns the values by name{labels}
+func gather(t *testing.T, e *Exporter) map[string]float64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(e)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flattenMetrics(families)
+}
+
+// Serves /metrics/lite once and returns the values by name{labels}
+func gatherLite(t *testing.T, e *Exporter) map[string]float64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newLiteCollector(e))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flattenMetrics(families)
+}
+
+// Reports whether any series of the metric family name was gathered
+func hasFamily(values map[string]float64, name string) bool {
+	for key := range values {
+		if key == name || strings.HasPrefix(key, name+"{") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAPIURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		baseURI   string
+		apiKey    string
+		keyInPath bool
+		want      string
+		redacted  string
+	}{
+		{
+			name:     "query parameter",
+			baseURI:  "http://127.0.0.1:8181",
+			apiKey:   "secret",
+			want:     "http://127.0.0.1:8181/api/v2?apikey=secret",
+			redacted: "http://127.0.0.1:8181/api/v2",
+		},
+		{
+			name:     "query parameter with base path",
+			baseURI:  "https://example.com/tautulli",
+			apiKey:   "secret",
+			want:     "https://example.com/tautulli/api/v2?apikey=secret",
+			redacted: "https://example.com/tautulli/api/v2",
+		},
+		{
+			name:      "path segment",
+			baseURI:   "http://127.0.0.1:8181",
+			apiKey:    "secret",
+			keyInPath: true,
+			want:      "http://127.0.0.1:8181/api/v2/secret",
+			redacted:  "http://127.0.0.1:8181/api/v2/REDACTED",
+		},
+		{
+			name:      "path segment that needs escaping",
+			baseURI:   "https://example.com/tautulli",
+			apiKey:    "se/cret",
+			keyInPath: true,
+			want:      "https://example.com/tautulli/api/v2/se%2Fcret",
+			redacted:  "https://example.com/tautulli/api/v2/REDACTED",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := apiURL(tt.baseURI, tt.apiKey, tt.keyInPath)
+			if err != nil {
+				t.Fatalf("apiURL() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("apiURL() = %q, want %q", got, tt.want)
+			}
+
+			u, err := url.Parse(got)
+			if err != nil {
+				t.Fatalf("can't parse %q: %v", got, err)
+			}
+			redacted := redactURL(u)
+			if redacted != tt.redacted {
+				t.Errorf("redactURL() = %q, want %q", redacted, tt.redacted)
+			}
+			if strings.Contains(redacted, "cret") {
+				t.Errorf("redactURL() = %q still contains the API key", redacted)
+			}
+		})
+	}
+}
+
+func TestMetricSchema(t *testing.T) {
+	v1Only := map[string]float64{
+		"tautulli_stream_count_transcode": 1,
+		"tautulli_stream_direct_play":     1,
+		"tautulli_stream_direct_stream":   0,
+		"tautulli_bandwidth_lan":          1000,
+		"tautulli_bandwidth_wan":          2000,
+		"tautulli_bandwidth_total":        3000,
+	}
+	v2 := map[string]float64{
+		`tautulli_streams{decision="transcode"}`:     1,
+		`tautulli_streams{decision="direct_play"}`:   1,
+		`tautulli_streams{decision="direct_stream"}`: 0,
+		`tautulli_bandwidth_kbps{location="lan"}`:    1000,
+		`tautulli_bandwidth_kbps{location="wan"}`:    2000,
+	}
+
+	for _, schema := range []string{"v1", "v2"} {
+		t.Run(schema, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.MetricSchema = schema
+			values := gather(t, newTestExporter(t, cfg, map[string]string{"get_activity": busyActivity}))
+
+			// The v1 names are kept in both schemas
+			for name, want := range v1Only {
+				if got, ok := values[name]; !ok || got != want {
+					t.Errorf("%s = %v (exported %v), want %v", name, got, ok, want)
+				}
+			}
+
+			for _, family := range []string{"tautulli_streams", "tautulli_bandwidth_kbps"} {
+				if hasFamily(values, family) != (schema == "v2") {
+					t.Errorf("%s exported = %v with schema %s", family, hasFamily(values, family), schema)
+				}
+			}
+			if schema != "v2" {
+				return
+			}
+			for name, want := range v2 {
+				if got, ok := values[name]; !ok || got != want {
+					t.Errorf("%s = %v (exported %v), want %v", name, got, ok, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricSchemaV2IgnoresBandwidthUnit(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MetricSchema = "v2"
+	cfg.BandwidthUnit = "bps"
+	values := gather(t, newTestExporter(t, cfg, map[string]string{"get_activity": busyActivity}))
+
+	if got := values["tautulli_bandwidth_lan"]; got != 1000000 {
+		t.Errorf("tautulli_bandwidth_lan = %v, want 1000000", got)
+	}
+	if got := values[`tautulli_bandwidth_kbps{location="lan"}`]; got != 1000 {
+		t.Errorf(`tautulli_bandwidth_kbps{location="lan"} = %v, want 1000`, got)
+	}
+}
+
+func TestHTMLResponse(t *testing.T) {
+	responses := map[string]string{"get_activity": "<html><body><h1>502 Bad Gateway</h1></body></html>"}
+	e := newTestExporter(t, testConfig(t), responses)
+
+	values := gather(t, e)
+	if got := values["tautulli_up"]; got != 0 {
+		t.Errorf("tautulli_up = %v, want 0", got)
+	}
+	if got := values[`tautulli_invalid_responses_total{command="get_activity"}`]; got != 1 {
+		t.Errorf(`tautulli_invalid_responses_total{command="get_activity"} = %v, want 1`, got)
+	}
+	if hasFamily(values, "tautulli_last_response_bytes") {
+		t.Error("tautulli_last_response_bytes set from an invalid response")
+	}
+
+	_, err := e.fetchDataContext(context.Background(), "get_activity", nil)
+	if !errors.Is(err, errInvalidResponse) {
+		t.Errorf("fetchDataContext() error = %v, want %v", err, errInvalidResponse)
+	}
+	values = gather(t, e)
+	if got := values[`tautulli_invalid_responses_total{command="get_activity"}`]; got != 3 {
+		t.Errorf(`tautulli_invalid_responses_total{command="get_activity"} = %v, want 3`, got)
+	}
+}
+
+// A body that fails partway through, like a connection that drops mid-response
+type failingReader struct {
+	data string
+	read bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.read {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.read = true
+	return copy(p, r.data), nil
+}
+
+func TestTruncatedResponse(t *testing.T) {
+	truncated := busyActivity[:len(busyActivity)/2]
+	tests := []struct {
+		name string
+		body func() io.Reader
+		want error
+	}{
+		{
+			name: "read error",
+			body: func() io.Reader { return &failingReader{data: truncated} },
+			want: io.ErrUnexpectedEOF,
+		},
+		{
+			name: "incomplete JSON",
+			body: func() io.Reader { return strings.NewReader(truncated) },
+			want: errInvalidResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExporter(t, testConfig(t), nil)
+			e.fetch = func(ctx context.Context, cmd string, params url.Values) (io.ReadCloser, error) {
+				return io.NopCloser(tt.body()), nil
+			}
+
+			_, err := e.fetchDataContext(context.Background(), "get_activity", nil)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("fetchDataContext() error = %v, want %v", err, tt.want)
+			}
+
+			values := gather(t, e)
+			if got := values["tautulli_up"]; got != 0 {
+				t.Errorf("tautulli_up = %v, want 0", got)
+			}
+			if got := values[`tautulli_invalid_responses_total{command="get_activity"}`]; got != 2 {
+				t.Errorf(`tautulli_invalid_responses_total{command="get_activity"} = %v, want 2`, got)
+			}
+			if got := values["tautulli_stream_count_transcode"]; got != 0 {
+				t.Errorf("tautulli_stream_count_transcode = %v from a truncated response, want 0", got)
+			}
+		})
+	}
+}
+
+func TestLastResponseBytes(t *testing.T) {
+	responses := map[string]string{"get_activity": busyActivity}
+	e := newTestExporter(t, testConfig(t), responses)
+	gather(t, e)
+
+	// A failed response keeps the size of the last good one
+	responses["get_activity"] = `{"response": {"result": "error", "message": "Invalid apikey", "data": {}}}`
+	values := gather(t, e)
+	if got := values[`tautulli_last_response_bytes{command="get_activity"}`]; got != float64(len(busyActivity)) {
+		t.Errorf(`tautulli_last_response_bytes{command="get_activity"} = %v, want %d`, got, len(busyActivity))
+	}
+}
+
+func TestStreamSampler(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newStreamSampler(5 * time.Minute)
+
+	// Samples from the ticker and from scrapes are interleaved at any rate
+	s.add(start, 4)
+	for i := 1; i <= 20; i++ {
+		s.add(start.Add(time.Duration(i)*10*time.Second), 1)
+	}
+	if got := s.max(start.Add(4 * time.Minute)); got != 4 {
+		t.Errorf("max() within the window = %v, want 4", got)
+	}
+	if got := s.max(start.Add(5*time.Minute + time.Second)); got != 1 {
+		t.Errorf("max() after the window = %v, want 1", got)
+	}
+	if got := s.max(start.Add(time.Hour)); got != 0 {
+		t.Errorf("max() with no samples in the window = %v, want 0", got)
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		check   func(t *testing.T, err error)
+	}{
+		{
+			name: "HTTP status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			},
+			check: func(t *testing.T, err error) {
+				var statusErr *httpStatusError
+				if !errors.As(err, &statusErr) || statusErr.statusCode != http.StatusServiceUnavailable {
+					t.Errorf("error = %v, want HTTP status %d", err, http.StatusServiceUnavailable)
+				}
+			},
+		},
+		{
+			name: "result",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{"response": {"result": "error", "message": "Invalid apikey", "data": {}}}`)
+			},
+			check: func(t *testing.T, err error) {
+				var resultErr *resultError
+				if !errors.As(err, &resultErr) || resultErr.cmd != "get_activity" || resultErr.result != "error" {
+					t.Errorf("error = %v, want an error result from get_activity", err)
+				}
+			},
+		},
+		{
+			name: "invalid response",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "<html>Bad Gateway</html>")
+			},
+			check: func(t *testing.T, err error) {
+				if !errors.Is(err, errInvalidResponse) {
+					t.Errorf("error = %v, want %v", err, errInvalidResponse)
+				}
+			},
+		},
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			check: func(t *testing.T, err error) {
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("error = %v, want %v", err, context.DeadlineExceeded)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			cfg := testConfig(t)
+			cfg.TautulliTimeout = 50 * time.Millisecond
+			e, err := NewExporter(server.URL+"/api/v2?apikey=secret", cfg, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = e.fetchDataContext(context.Background(), "get_activity", nil)
+			if err == nil {
+				t.Fatal("fetchDataContext() didn't return an error")
+			}
+			tt.check(t, err)
+			if strings.Contains(err.Error(), "secret") {
+				t.Errorf("error %q contains the API key", err)
+			}
+		})
+	}
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ScrapeTimeout = 10 * time.Millisecond
+	e := newTestExporter(t, cfg, nil)
+	release := make(chan struct{})
+	e.fetch = func(ctx context.Context, cmd string, params url.Values) (io.ReadCloser, error) {
+		<-release
+		return nil, ctx.Err()
+	}
+	defer close(release)
+
+	values := gather(t, e)
+	if got := values["tautulli_up"]; got != 0 {
+		t.Errorf("tautulli_up = %v, want 0", got)
+	}
+	if got := values[`tautulli_collector_timeouts_total{collector="activity"}`]; got != 1 {
+		t.Errorf(`tautulli_collector_timeouts_total{collector="activity"} = %v, want 1`, got)
+	}
+}
+
+func TestLateActivityIsDiscarded(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ScrapeTimeout = 20 * time.Millisecond
+	cfg.SessionMetrics = true
+	e := newTestExporter(t, cfg, nil)
+
+	// get_activity answers after the deadline without checking the context, like a slow proxy would
+	late := make(chan struct{})
+	e.fetch = func(ctx context.Context, cmd string, params url.Values) (io.ReadCloser, error) {
+		<-late
+		return io.NopCloser(strings.NewReader(busyActivity)), nil
+	}
+	time.AfterFunc(2*cfg.ScrapeTimeout, func() { close(late) })
+
+	values := gather(t, e)
+	if got := values["tautulli_up"]; got != 0 {
+		t.Fatalf("tautulli_up = %v, want 0", got)
+	}
+	e.pending.Wait()
+	if !e.lastActivityAt.IsZero() || len(e.sessionStates) > 0 || len(e.viewOffsets) > 0 || e.maxStreams != 0 {
+		t.Errorf("late get_activity response changed the exporter's state: lastActivityAt %v, %d session states, %d view offsets, maxStreams %v",
+			e.lastActivityAt, len(e.sessionStates), len(e.viewOffsets), e.maxStreams)
+	}
+
+	// Nor does the next scrape pick up anything from the late response
+	e.fetch = fixtureFetch(map[string]string{"get_activity": idleActivity})
+	values = gather(t, e)
+	for _, name := range []string{"tautulli_stream_count", "tautulli_stream_count_max", "tautulli_stream_seconds_total", "tautulli_stalled_sessions"} {
+		if got := values[name]; got != 0 {
+			t.Errorf("%s = %v after a late response, want 0", name, got)
+		}
+	}
+	if hasFamily(values, "tautulli_session_bandwidth_kbps") {
+		t.Error("tautulli_session_bandwidth_kbps exported from a late response")
+	}
+}
+
+func TestIdleAfterBusy(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MetricSchema = "v2"
+	cfg.SessionMetrics = true
+	responses := map[string]string{"get_activity": busyActivity}
+	e := newTestExporter(t, cfg, responses)
+
+	values := gather(t, e)
+	for _, family := range []string{"tautulli_stream_count_by_location", "tautulli_stream_count_by_library", "tautulli_session_bandwidth_kbps"} {
+		if !hasFamily(values, family) {
+			t.Fatalf("%s isn't exported while streams are playing", family)
+		}
+	}
+
+	responses["get_activity"] = idleActivity
+	values = gather(t, e)
+	if got := values["tautulli_up"]; got != 1 {
+		t.Fatalf("tautulli_up = %v, want 1", got)
+	}
+
+	// High-water marks and counters keep what they saw while the streams were playing
+	kept := map[string]bool{
+		"tautulli_stream_count_max":     true,
+		"tautulli_stream_seconds_total": true,
+	}
+	for key, value := range values {
+		name := key
+		if i := strings.Index(key, "{"); i >= 0 {
+			name = key[:i]
+		}
+		switch {
+		case strings.HasPrefix(name, "tautulli_stream_count_by_") || strings.HasPrefix(name, "tautulli_session_"):
+			t.Errorf("%s is still exported after the streams stopped", key)
+		case kept[name]:
+		case strings.HasPrefix(name, "tautulli_stream") || strings.HasPrefix(name, "tautulli_bandwidth"):
+			if value != 0 {
+				t.Errorf("%s = %v after the streams stopped, want 0", key, value)
+			}
+		}
+	}
+}
+
+func TestMachineIDLabel(t *testing.T) {
+	found, missing := t.TempDir(), t.TempDir()
+	identity := `{"response": {"result": "success", "message": null, "data": {"machine_identifier": "abc123"}}}`
+	if err := os.WriteFile(filepath.Join(found, "get_server_identity.json"), []byte(identity), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A server whose identity can't be fetched still gets the label, so both can be registered together
+	registry := prometheus.NewRegistry()
+	for server, dir := range map[string]string{"found": found, "missing": missing} {
+		cfg := testConfig(t)
+		cfg.MachineIDLabel = true
+		cfg.FileSource = dir
+		e, err := NewExporter("http://127.0.0.1:8181/api/v2?apikey=secret", cfg, prometheus.Labels{"server": server})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := registry.Register(e); err != nil {
+			t.Fatalf("can't register the %s server: %v", server, err)
+		}
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := flattenMetrics(families)
+	for _, key := range []string{
+		`tautulli_up{machine_identifier="abc123",server="found"}`,
+		`tautulli_up{machine_identifier="",server="missing"}`,
+	} {
+		if _, ok := values[key]; !ok {
+			t.Errorf("%s isn't exported", key)
+		}
+	}
+}
+
+func TestLiteCollector(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.SessionMetrics = true
+	e := newTestExporter(t, cfg, map[string]string{"get_activity": busyActivity})
+	detailed := []string{
+		"tautulli_session_bandwidth_kbps",
+		"tautulli_user_distinct_platforms",
+		"tautulli_stream_count_by_player",
+		"tautulli_transcode_count_by_platform",
+	}
+
+	values := gather(t, e)
+	for _, family := range detailed {
+		if !hasFamily(values, family) {
+			t.Fatalf("%s isn't exported on /metrics", family)
+		}
+	}
+
+	values = gatherLite(t, e)
+	for _, family := range detailed {
+		if hasFamily(values, family) {
+			t.Errorf("%s is exported on /metrics/lite", family)
+		}
+	}
+	if got := values["tautulli_stream_count"]; got != 2 {
+		t.Errorf("tautulli_stream_count = %v on /metrics/lite, want 2", got)
+	}
+}
+
+func TestCheckAPIKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		file    string
+		server  serverConfig
+		wantErr bool
+	}{
+		{
+			name: "environment only",
+			env:  map[string]string{"TAUTULLI_API_KEY": "secret"},
+		},
+		{
+			name:    "missing",
+			wantErr: true,
+		},
+		{
+			name:    "blank",
+			env:     map[string]string{"TAUTULLI_API_KEY": "  "},
+			wantErr: true,
+		},
+		{
+			name: "config file",
+			file: "tautulli_api_key: secret\n",
+		},
+		{
+			name:    "blank in the config file",
+			file:    "tautulli_api_key: \"\"\n",
+			wantErr: true,
+		},
+		{
+			name:   "server in the config file",
+			server: serverConfig{Name: "home", TautulliApiKey: "secret"},
+		},
+		{
+			name:    "tenant without its own key",
+			env:     map[string]string{"TAUTULLI_API_KEY": "secret"},
+			server:  serverConfig{Name: "home", Tenant: "alice"},
+			wantErr: true,
+		},
+		{
+			name: "file source",
+			env:  map[string]string{"TAUTULLI_FILE_SOURCE": "testdata"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Starts without a key, t.Setenv puts back whatever the environment had afterwards
+			t.Setenv("TAUTULLI_API_KEY", "")
+			os.Unsetenv("TAUTULLI_API_KEY")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			var cfg config
+			if err := env.Parse(&cfg); err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.file) > 0 {
+				path := filepath.Join(t.TempDir(), "config.yml")
+				if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if err := loadConfigFile(path, &cfg); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := checkAPIKey(cfg.forServer(tt.server))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkAPIKey() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStreamSecondsSkipsFailedScrapes(t *testing.T) {
+	responses := map[string]string{"get_activity": busyActivity}
+	e := newTestExporter(t, testConfig(t), responses)
+	gather(t, e)
+
+	// Activity fails for a while, then comes back with the same streams
+	responses["get_activity"] = "<html>Bad Gateway</html>"
+	gather(t, e)
+	time.Sleep(50 * time.Millisecond)
+	responses["get_activity"] = busyActivity
+	values := gather(t, e)
+
+	if got := values["tautulli_stream_seconds_total"]; got >= 2*0.05 {
+		t.Errorf("tautulli_stream_seconds_total = %v, want the failed scrapes left out", got)
+	}
+}
+
+func TestStreamSecondsSkipsTimedOutScrapes(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ScrapeTimeout = 20 * time.Millisecond
+	e := newTestExporter(t, cfg, map[string]string{"get_activity": busyActivity})
+	gather(t, e)
+
+	// The response arrives after the deadline, once the scrape has already cleared the previous activity time
+	late := make(chan struct{})
+	e.fetch = func(ctx context.Context, cmd string, params url.Values) (io.ReadCloser, error) {
+		<-late
+		return io.NopCloser(strings.NewReader(busyActivity)), nil
+	}
+	time.AfterFunc(2*cfg.ScrapeTimeout, func() { close(late) })
+	gather(t, e)
+	e.pending.Wait()
+
+	time.Sleep(50 * time.Millisecond)
+	e.fetch = fixtureFetch(map[string]string{"get_activity": busyActivity})
+	values := gather(t, e)
+	if got := values["tautulli_stream_seconds_total"]; got != 0 {
+		t.Errorf("tautulli_stream_seconds_total = %v, want the timed out scrape and the gap after it left out", got)
+	}
+}
+
+func TestDedupeSessions(t *testing.T) {
+	tests := []struct {
+		name       string
+		sessions   string
+		want       []string
+		duplicates int
+	}{
+		{
+			name:     "no duplicates",
+			sessions: `[{"session_key": "1", "state": "playing"}, {"session_key": "2", "state": "paused"}]`,
+			want:     []string{"1:playing", "2:paused"},
+		},
+		{
+			name:       "last entry wins",
+			sessions:   `[{"session_key": "1", "state": "buffering"}, {"session_key": "2", "state": "paused"}, {"session_key": "1", "state": "playing"}]`,
+			want:       []string{"1:playing", "2:paused"},
+			duplicates: 1,
+		},
+		{
+			name:       "listed three times",
+			sessions:   `[{"session_key": "1", "state": "buffering"}, {"session_key": "1", "state": "paused"}, {"session_key": "1", "state": "playing"}]`,
+			want:       []string{"1:playing"},
+			duplicates: 2,
+		},
+		{
+			name:     "empty session keys aren't merged",
+			sessions: `[{"session_key": "", "state": "playing"}, {"state": "paused"}, {"session_key": "", "state": "buffering"}]`,
+			want:     []string{":playing", ":paused", ":buffering"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deduped, duplicates := dedupeSessions(gjson.Parse(tt.sessions).Array())
+			var got []string
+			for _, session := range deduped {
+				got = append(got, session.Get("session_key").String()+":"+session.Get("state").String())
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("dedupeSessions() = %v, want %v", got, tt.want)
+			}
+			if duplicates != tt.duplicates {
+				t.Errorf("dedupeSessions() duplicates = %d, want %d", duplicates, tt.duplicates)
+			}
+		})
+	}
+}
+
+func TestRedactAPIKey(t *testing.T) {
+	tests := map[string]string{
+		"":                                 "<not set>",
+		"short":                            "<redacted>",
+		"0123456789abcdef0123456789abcdef": "...cdef",
+	}
+	for key, want := range tests {
+		if got := redactAPIKey(key); got != want {
+			t.Errorf("redactAPIKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// A socket left behind is replaced
+	socket := filepath.Join(dir, "exporter.sock")
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	l, err := listen("unix:" + socket)
+	if err != nil {
+		t.Fatalf("listen() on a stale socket error = %v", err)
+	}
+	l.Close()
+
+	// Anything else is never deleted
+	file := filepath.Join(dir, "config.yml")
+	if err := os.WriteFile(file, []byte("tautulli_api_key: secret\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := listen("unix:" + file); err == nil {
+		l.Close()
+		t.Fatal("listen() on a regular file didn't return an error")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("listen() removed the regular file: %v", err)
+	}
+}
+
+func TestBaseURLMatchesTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseURL string
+		want    float64
+		missing bool
+	}{
+		{name: "same host", baseURL: "http://127.0.0.1:8181", want: 1},
+		{name: "moved", baseURL: "https://tautulli.example.com", want: 0},
+		{name: "not set", baseURL: "", missing: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.Collectors = []string{"base_url"}
+			settings := fmt.Sprintf(`{"response": {"result": "success", "message": null, "data": {"http_base_url": %q, "http_root": ""}}}`, tt.baseURL)
+			e := newTestExporter(t, cfg, map[string]string{"get_activity": idleActivity, "get_settings": settings})
+
+			values := gather(t, e)
+			got, ok := values["tautulli_base_url_matches_target"]
+			if ok == tt.missing || got != tt.want {
+				t.Errorf("tautulli_base_url_matches_target = %v (exported %v), want %v (exported %v)", got, ok, tt.want, !tt.missing)
+			}
+		})
+	}
+}
+
+func TestPmsReachable(t *testing.T) {
+	status := func(fields string) string {
+		return `{"response": {"result": "success", "message": null, "data": {` + fields + `}}}`
+	}
+
+	// Neither without the collector nor without the field is the connection reported as lost
+	values := gather(t, newTestExporter(t, testConfig(t), map[string]string{"get_activity": idleActivity}))
+	if hasFamily(values, "tautulli_pms_reachable") {
+		t.Error("tautulli_pms_reachable exported without the server_status collector")
+	}
+
+	cfg := testConfig(t)
+	cfg.Collectors = []string{"server_status"}
+	responses := map[string]string{"get_activity": idleActivity, "server_status": status(`"connected": true`)}
+	e := newTestExporter(t, cfg, responses)
+	if got := gather(t, e)["tautulli_pms_reachable"]; got != 1 {
+		t.Errorf("tautulli_pms_reachable = %v, want 1", got)
+	}
+
+	responses["server_status"] = status(`"tautulli_version": "v2.14.0"`)
+	values = gather(t, e)
+	if hasFamily(values, "tautulli_pms_reachable") {
+		t.Error("tautulli_pms_reachable exported without a connected field")
+	}
+	if got := values[`tautulli_pms_connection_events_total{event="disconnected"}`]; got != 0 {
+		t.Errorf(`tautulli_pms_connection_events_total{event="disconnected"} = %v without a connected field, want 0`, got)
+	}
+
+	responses["server_status"] = status(`"connected": false`)
+	values = gather(t, e)
+	if got, ok := values["tautulli_pms_reachable"]; !ok || got != 0 {
+		t.Errorf("tautulli_pms_reachable = %v (exported %v), want 0", got, ok)
+	}
+	if got := values[`tautulli_pms_connection_events_total{event="disconnected"}`]; got != 1 {
+		t.Errorf(`tautulli_pms_connection_events_total{event="disconnected"} = %v, want 1`, got)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, idleActivity)
+	}))
+	defer secure.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, secure.URL+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}))
+	defer plain.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: secure.Certificate().Raw})
+	if err := os.WriteFile(caFile, certificate, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	newExporter := func(caFile string) *Exporter {
+		cfg := testConfig(t)
+		cfg.FollowRedirects = true
+		cfg.TautulliCaFile = caFile
+		e, err := NewExporter(plain.URL+"/api/v2?apikey=secret", cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	// The redirected request has to use the TLS settings even though TAUTULLI_URI is plain HTTP
+	if _, err := newExporter(caFile).fetchDataContext(context.Background(), "get_activity", nil); err != nil {
+		t.Errorf("fetchDataContext() with TAUTULLI_CA_FILE error = %v", err)
+	}
+	if _, err := newExporter("").fetchDataContext(context.Background(), "get_activity", nil); !isTLSVerifyError(err) {
+		t.Errorf("fetchDataContext() without TAUTULLI_CA_FILE error = %v, want a certificate error", err)
+	}
+}
+
+func TestMinTLSVersionForPlainHTTP(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MinTLSVersion = "1.4"
+	if _, err := NewExporter("http://127.0.0.1:8181/api/v2?apikey=secret", cfg, nil); err == nil {
+		t.Error("NewExporter() accepted an unknown TAUTULLI_MIN_TLS_VERSION for an http URI")
+	}
+}
+
+func TestHTTPServerCleartextHTTP2(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newHTTPServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}), time.Minute, time.Minute)
+	go server.Serve(listener)
+	defer server.Close()
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := http.Client{Transport: &http.Transport{Protocols: protocols}}
+	resp, err := client.Get("http://" + listener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	proto, _ := io.ReadAll(resp.Body)
+	if string(proto) != "HTTP/2.0" {
+		t.Errorf("request served over %s, want HTTP/2.0", proto)
+	}
+}
+
+func TestStalledSessions(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StallAfter = 50 * time.Millisecond
+	responses := map[string]string{"get_activity": busyActivity}
+	e := newTestExporter(t, cfg, responses)
+
+	// Scrapes closer together than Plex updates the position don't count as stalls
+	gather(t, e)
+	if got := gather(t, e)["tautulli_stalled_sessions"]; got != 0 {
+		t.Errorf("tautulli_stalled_sessions = %v right after the first scrape, want 0", got)
+	}
+
+	time.Sleep(cfg.StallAfter)
+	if got := gather(t, e)["tautulli_stalled_sessions"]; got != 2 {
+		t.Errorf("tautulli_stalled_sessions = %v after STALL_THRESHOLD, want 2", got)
+	}
+
+	// Moving on starts over
+	responses["get_activity"] = strings.Replace(busyActivity, `"view_offset": 60000`, `"view_offset": 70000`, 1)
+	if got := gather(t, e)["tautulli_stalled_sessions"]; got != 1 {
+		t.Errorf("tautulli_stalled_sessions = %v after one session moved on, want 1", got)
+	}
+}
+
+func TestLiteCollectorReusesLastScrape(t *testing.T) {
+	e := newTestExporter(t, testConfig(t), nil)
+	fetches := 0
+	responses := fixtureFetch(map[string]string{"get_activity": busyActivity})
+	e.fetch = func(ctx context.Context, cmd string, params url.Values) (io.ReadCloser, error) {
+		fetches++
+		return responses(ctx, cmd, params)
+	}
+
+	// A lite request right after /metrics serves that scrape's values
+	gather(t, e)
+	values := gatherLite(t, e)
+	if fetches != 1 {
+		t.Errorf("/metrics then /metrics/lite fetched get_activity %d times, want 1", fetches)
+	}
+	if got := values["tautulli_exporter_total_scrapes"]; got != 1 {
+		t.Errorf("tautulli_exporter_total_scrapes = %v on /metrics/lite, want 1", got)
+	}
+	if got := values["tautulli_stream_count"]; got != 2 {
+		t.Errorf("tautulli_stream_count = %v on /metrics/lite, want 2", got)
+	}
+
+	// Without a /metrics scrape in between, lite scrapes by itself
+	gatherLite(t, e)
+	if fetches != 2 {
+		t.Errorf("a second /metrics/lite request fetched get_activity %d times in total, want 2", fetches)
+	}
+}